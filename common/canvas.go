@@ -0,0 +1,154 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"golang.org/x/image/colornames"
+	"image/color"
+	"image/png"
+	"os"
+)
+
+// Transform palette with color names to RGBA.
+func MakePalette(colorNames []string) color.Palette {
+	palette := make(color.Palette, len(colorNames))
+	for i, colorName := range colorNames {
+		palette[i] = colornames.Map[colorName]
+	}
+	return palette
+}
+
+// Read PNG image and convert it to canvas color codes using closest available color.
+// Image is repeated if it is smaller than canvas. Return color codes row by row (len is width * height).
+func ReadInitialImage(path string, colorNames []string, width, height int) ([]byte, error) {
+	pow2 := func(x float32) float32 {
+		return x * x
+	}
+
+	paletteRGBA := make([]color.RGBA, len(colorNames))
+	for i, colorName := range colorNames {
+		paletteRGBA[i] = colornames.Map[colorName]
+	}
+
+	// Return index of palette color closest to given RGB color.
+	// Distance formula is: (0.3(R1 - R2))^2 + (0.59(G1 - G2))^2 + (0.11(B1 - B2))^2.
+	// See https://stackoverflow.com/a/1847112.
+	getClosestColor := func(first color.RGBA) byte {
+		var minDistance float32
+		var minDistanceColorIndex int
+		for i, second := range paletteRGBA {
+			dist := pow2((float32(first.R)-float32(second.R))*0.3) +
+				pow2((float32(first.G)-float32(second.G))*0.59) +
+				pow2((float32(first.B)-float32(second.B))*0.11)
+
+			if i == 0 || dist < minDistance {
+				minDistance = dist
+				minDistanceColorIndex = i
+			}
+		}
+		return byte(minDistanceColorIndex)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	imgWidth := bounds.Dx()
+	imgHeight := bounds.Dy()
+	if imgWidth == 0 || imgHeight == 0 {
+		return nil, fmt.Errorf("%s: image is empty", path)
+	}
+
+	canvas := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		imgY := bounds.Min.Y + y%imgHeight
+		for x := 0; x < width; x++ {
+			imgX := bounds.Min.X + x%imgWidth
+			imgColor := color.RGBAModel.Convert(img.At(imgX, imgY)).(color.RGBA)
+			canvas[y*width+x] = getClosestColor(imgColor)
+		}
+	}
+
+	return canvas, nil
+}
+
+// Assemble whole canvas from checkpoints and placement logs of all ws_server instances.
+// Return color codes row by row (len is CanvasCols * CanvasRows).
+func LoadCanvas(rdb *redis.Client, appConfig *AppConfig, canvasConfig *CanvasConfig) ([]byte, error) {
+	shardMap, err := GetShardMap(rdb, canvasConfig, appConfig.ShardCount)
+	if err != nil {
+		return nil, err
+	}
+	return AssembleCanvas(rdb, canvasConfig, shardMap.Layout)
+}
+
+// Assemble canvas from checkpoints and placement logs made with given layout.
+// Colors outside of palette are not trusted: such checkpoint pixels get first palette color
+// and such placements are skipped, like in ws_server.
+func AssembleCanvas(rdb *redis.Client, canvasConfig *CanvasConfig, layout *CanvasLayout) ([]byte, error) {
+	canvasName := canvasConfig.Name
+	paletteSize := len(canvasConfig.PaletteColors)
+	width := layout.Width
+	height := layout.Height
+
+	canvas := make([]byte, width*height)
+	for shard := 0; shard < layout.Shards; shard++ {
+		instanceLayout := layout.ForInstance(shard)
+
+		snapshot, err := GetCanvasSnapshot(rdb, canvasName, shard)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot == nil ||
+			!snapshot.Layout.Equal(layout) ||
+			len(snapshot.ColorCodes) != instanceLayout.DataSize() {
+			return nil, fmt.Errorf("no checkpoint for instance %d", shard)
+		}
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if i := instanceLayout.Index(x, y); i >= 0 && int(snapshot.ColorCodes[i]) < paletteSize {
+					canvas[y*width+x] = snapshot.ColorCodes[i]
+				}
+			}
+		}
+
+		err = ForEachPlacement(rdb, canvasName, shard, snapshot.LastPlacementId, func(event *PlacementEvent) error {
+			if instanceLayout.Index(event.X, event.Y) >= 0 && int(event.Color) < paletteSize {
+				canvas[event.Y*width+event.X] = event.Color
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return canvas, nil
+}
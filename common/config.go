@@ -20,10 +20,33 @@ package common
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"regexp"
+	"strings"
 )
 
-type AppConfig struct {
+// Secrets shorter than that are rejected.
+const minSecretLength = 32
+
+// Limits of binary websocket protocol (see ws_server/protocol.go): canvas index and color code
+// take one byte, pixel coordinates and instance number take two bytes.
+const (
+	MaxCanvases      = 256
+	MaxPaletteColors = 256
+	MaxCanvasSide    = 65536
+	MaxShardCount    = 65536
+)
+
+// Canvas names go into redis keys (separated by ':'), URLs and channel names, so only safe characters are allowed.
+var canvasNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Settings of one canvas (room). Deployment may serve several independent canvases.
+type CanvasConfig struct {
+	// Canvas id. Used in URLs, websocket messages and redis keys.
+	Name string
+
 	CanvasRows      int
 	CanvasCols      int
 	CooldownSeconds int
@@ -31,13 +54,121 @@ type AppConfig struct {
 	PaletteColors []string
 	InitialImage  string
 
+	// Canvas is split into ChunkSize x ChunkSize chunks, each chunk is managed by one ws_server instance.
+	ChunkSize int
+	// Owner instance of chunk by "chunkX:chunkY". Chunks not listed here are assigned round-robin.
+	ChunkOwners map[string]int
+}
+
+type AppConfig struct {
+	Canvases []CanvasConfig
+
 	RedisAddress  string
 	RedisPassword string
 	RedisDatabase int
 
 	AllowedOrigins string
 
-	WebSocketAppAddresses []string
+	// Session expires if it is not used for `SessionIdleSeconds' seconds
+	// and `SessionMaxAgeSeconds' seconds after it was created in any case.
+	SessionIdleSeconds   int
+	SessionMaxAgeSeconds int
+
+	// Brute-force protection. After `LoginFreeAttempts' failed logins (`LoginFreeAttemptsPerIP' from one IP)
+	// during `LoginFailureWindowSeconds' seconds login (IP) is locked for `LoginLockBaseSeconds' seconds,
+	// lock time doubles with every next failure up to `LoginLockMaxSeconds' seconds.
+	// Locked login may still be tried once from IP without failed attempts, so user is not locked out by others.
+	LoginFreeAttempts         int
+	LoginFreeAttemptsPerIP    int
+	LoginFailureWindowSeconds int
+	LoginLockBaseSeconds      int
+	LoginLockMaxSeconds       int
+	// Header with client IP set by reverse proxy. Empty if there is no proxy. Only the last address
+	// in header is trusted, so it should be "X-Real-IP" overwritten by proxy or "X-Forwarded-For"
+	// appended by it (and only one proxy should be in front of server).
+	ClientIPHeader string
+	// Logins of users who may see and clear lockouts (/admin/lockouts).
+	Admins []string
+	// Logins nobody can register, in addition to built-in ones like "admin" (see IsReservedLogin).
+	ReservedLogins []string
+
+	// Algorithm for new password hashes: "argon2id" (default) or "bcrypt". Hashes made with
+	// other algorithm or costs are replaced when user logs in.
+	PasswordHasher string
+	BcryptCost     int
+	// Argon2id costs: passes over memory, memory in KiB and number of threads.
+	Argon2Time      int
+	Argon2MemoryKiB int
+	Argon2Threads   int
+	// Stored argon2id hashes asking for more memory are rejected. Default is 256 MiB.
+	Argon2MaxMemoryKiB int
+	// Passwords shorter than that (in characters) are rejected on registration.
+	PasswordMinLength int
+
+	// Key for signing session cookies. Read from SHITTYPIXELS_COOKIE_SECRET environment variable
+	// or from file named by SHITTYPIXELS_COOKIE_SECRET_FILE (see loadSecret).
+	CookieSecret string
+	// Attributes of session cookie. Secure should be set when site is served over HTTPS.
+	// SameSite is "Strict", "Lax" (default) or "None".
+	CookieSecure   bool
+	CookieSameSite string
+	CookieDomain   string
+
+	// Key for signing tickets which let browsers connect to ws_server (see IssueWebSocketTicket).
+	// Should not be kept in config file: it is read from SHITTYPIXELS_WS_TICKET_SECRET environment
+	// variable or from file named by SHITTYPIXELS_WS_TICKET_SECRET_FILE (see loadSecret).
+	WebSocketTicketSecret string
+	// Lifetime of ticket. Browser gets new ones from main server while page is open.
+	WebSocketTicketSeconds int
+
+	// Number of shards. Each ws_server instance claims one shard (see ShardLease).
+	ShardCount int
+	// Instance loses its shard if it does not renew lease for that long.
+	ShardLeaseSeconds int
+	// Public address of ws_server running with -gateway flag. If set, browsers connect only to gateway
+	// and gateway forwards requests to instances holding shards. If empty, browsers connect to
+	// addresses instances advertise (ws_server -advertise flag), so they must be reachable by browsers.
+	GatewayAddress string
+	// Max number of messages waiting to be sent to websocket client. Slower clients are dropped.
+	SendQueueLength int
+	// Client is dropped if writing one message to it takes longer.
+	WriteTimeoutSeconds int
+	// Websocket clients are pinged every `PingIntervalSeconds' seconds. Client which sends nothing
+	// (not even pong) for `MaxIdleSeconds' seconds is dropped as dead.
+	PingIntervalSeconds int
+	MaxIdleSeconds      int
+	// Number of recent pixel changes each instance keeps for reconnecting clients (see "resume" method).
+	ResumeHistoryLength int
+	// Pixel updates are collected for that long and sent to clients in one pixelBatch message.
+	BroadcastTickMilliseconds int
+
+	// Save canvas matrix to redis every `CheckpointIntervalSeconds' seconds
+	// or after `CheckpointEveryPlacements' placements, whichever comes first.
+	CheckpointIntervalSeconds int
+	CheckpointEveryPlacements int
+	// Remove placements included into checkpoint from log, so log does not grow without limit.
+	// Off by default: /timelapse.gif needs whole log and is disabled once log was trimmed.
+	TrimPlacementLog bool
+}
+
+// Is user admin (see Admins).
+func (c *AppConfig) IsAdmin(login string) bool {
+	for _, admin := range c.Admins {
+		if login != "" && NormalizeLogin(admin) == NormalizeLogin(login) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get canvas settings by name. Return nil if there is no such canvas.
+func (c *AppConfig) GetCanvas(name string) *CanvasConfig {
+	for i := range c.Canvases {
+		if c.Canvases[i].Name == name {
+			return &c.Canvases[i]
+		}
+	}
+	return nil
 }
 
 // Read configuration file. Panic on error
@@ -53,5 +184,92 @@ func MustReadAppConfig(path string) *AppConfig {
 	if err := decoder.Decode(&config); err != nil {
 		panic(err)
 	}
+	if len(config.Canvases) == 0 {
+		panic("config has no canvases")
+	}
+	if config.ShardCount <= 0 {
+		panic("config has no shards")
+	}
+	if err := checkCanvasNames(&config); err != nil {
+		panic(err)
+	}
+	if err := checkProtocolLimits(&config); err != nil {
+		panic(err)
+	}
+	var err error
+	config.CookieSecret, err = loadSecret("CookieSecret", config.CookieSecret, "SHITTYPIXELS_COOKIE_SECRET")
+	if err != nil {
+		panic(err)
+	}
+	config.WebSocketTicketSecret, err = loadSecret(
+		"WebSocketTicketSecret", config.WebSocketTicketSecret, "SHITTYPIXELS_WS_TICKET_SECRET")
+	if err != nil {
+		panic(err)
+	}
 	return &config
 }
+
+// Check that canvas names are not empty, unique and consist of letters, digits, '_' and '-'.
+func checkCanvasNames(config *AppConfig) error {
+	seen := make(map[string]bool, len(config.Canvases))
+	for i := range config.Canvases {
+		name := config.Canvases[i].Name
+		if !canvasNameRegexp.MatchString(name) {
+			return fmt.Errorf("canvas #%d: name %q should consist of letters, digits, '_' and '-'", i, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("canvas #%d: name %s is used by several canvases", i, name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// Check that canvases and shards can be described by binary websocket protocol.
+func checkProtocolLimits(config *AppConfig) error {
+	if len(config.Canvases) > MaxCanvases {
+		return fmt.Errorf("config has %d canvases, at most %d are supported", len(config.Canvases), MaxCanvases)
+	}
+	if config.ShardCount > MaxShardCount {
+		return fmt.Errorf("ShardCount is %d, at most %d is supported", config.ShardCount, MaxShardCount)
+	}
+	for i := range config.Canvases {
+		canvas := &config.Canvases[i]
+		if canvas.CanvasCols <= 0 || canvas.CanvasCols > MaxCanvasSide ||
+			canvas.CanvasRows <= 0 || canvas.CanvasRows > MaxCanvasSide {
+			return fmt.Errorf("canvas %s: size should be from 1 to %d", canvas.Name, MaxCanvasSide)
+		}
+		if len(canvas.PaletteColors) == 0 || len(canvas.PaletteColors) > MaxPaletteColors {
+			return fmt.Errorf("canvas %s: palette should have from 1 to %d colors", canvas.Name, MaxPaletteColors)
+		}
+	}
+	return nil
+}
+
+// Secret from environment variable `envName', from file named by `envName'_FILE variable
+// (docker secrets) or from config, in this order. Empty, short and placeholder secrets are rejected,
+// so server does not start with key everybody knows.
+func loadSecret(name string, configValue string, envName string) (string, error) {
+	secret := configValue
+	if value := os.Getenv(envName); value != "" {
+		secret = value
+	} else if path := os.Getenv(envName + "_FILE"); path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+		secret = strings.TrimSpace(string(content))
+	}
+
+	if secret == "" {
+		return "", fmt.Errorf("%s is not set, set %s environment variable", name, envName)
+	}
+	lower := strings.ToLower(secret)
+	if strings.Contains(lower, "change-me") || strings.Contains(lower, "changeme") {
+		return "", fmt.Errorf("%s is a placeholder, set real secret", name)
+	}
+	if len(secret) < minSecretLength {
+		return "", fmt.Errorf("%s should be at least %d characters long", name, minSecretLength)
+	}
+	return secret, nil
+}
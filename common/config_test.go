@@ -0,0 +1,80 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"testing"
+)
+
+func TestCheckProtocolLimits(t *testing.T) {
+	canvas := func(cols, rows, colors int) CanvasConfig {
+		return CanvasConfig{Name: "test", CanvasCols: cols, CanvasRows: rows, PaletteColors: make([]string, colors)}
+	}
+	tooManyCanvases := make([]CanvasConfig, MaxCanvases+1)
+	for i := range tooManyCanvases {
+		tooManyCanvases[i] = canvas(16, 16, 2)
+	}
+	cases := []struct {
+		name     string
+		canvases []CanvasConfig
+		shards   int
+		ok       bool
+	}{
+		{"largest", []CanvasConfig{canvas(MaxCanvasSide, MaxCanvasSide, MaxPaletteColors)}, MaxShardCount, true},
+		{"too many shards", []CanvasConfig{canvas(16, 16, 2)}, MaxShardCount + 1, false},
+		{"too wide", []CanvasConfig{canvas(MaxCanvasSide+1, 16, 2)}, 1, false},
+		{"too high", []CanvasConfig{canvas(16, MaxCanvasSide+1, 2)}, 1, false},
+		{"empty canvas", []CanvasConfig{canvas(0, 16, 2)}, 1, false},
+		{"too many colors", []CanvasConfig{canvas(16, 16, MaxPaletteColors+1)}, 1, false},
+		{"no colors", []CanvasConfig{canvas(16, 16, 0)}, 1, false},
+		{"too many canvases", tooManyCanvases, 1, false},
+	}
+	for _, c := range cases {
+		err := checkProtocolLimits(&AppConfig{Canvases: c.canvases, ShardCount: c.shards})
+		if (err == nil) != c.ok {
+			t.Errorf("%s: error is %v", c.name, err)
+		}
+	}
+}
+
+func TestCheckCanvasNames(t *testing.T) {
+	cases := []struct {
+		name  string
+		names []string
+		ok    bool
+	}{
+		{"valid", []string{"main", "Canvas_2", "test-3"}, true},
+		{"empty", []string{"main", ""}, false},
+		{"duplicate", []string{"main", "other", "main"}, false},
+		{"colon", []string{"main:1"}, false},
+		{"space", []string{"main canvas"}, false},
+		{"slash", []string{"main/1"}, false},
+		{"non-ascii", []string{"холст"}, false},
+	}
+	for _, c := range cases {
+		config := AppConfig{}
+		for _, name := range c.names {
+			config.Canvases = append(config.Canvases, CanvasConfig{Name: name})
+		}
+		err := checkCanvasNames(&config)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: error is %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Names of cookies with session id and with CSRF token of anonymous visitor.
+const (
+	SessionCookieName = "sessionId"
+	CsrfCookieName    = "csrfToken"
+)
+
+// Base64 HMAC-SHA256 of payload.
+func hmacSign(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Cookie value with signature: "<value>.<signature>".
+func SignCookieValue(appConfig *AppConfig, value string) string {
+	return value + "." + hmacSign(appConfig.CookieSecret, value)
+}
+
+// Check signature of cookie value made by SignCookieValue. Return value without signature.
+func VerifyCookieValue(appConfig *AppConfig, signed string) (string, bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	value := signed[:i]
+	if !hmac.Equal([]byte(signed[i+1:]), []byte(hmacSign(appConfig.CookieSecret, value))) {
+		return "", false
+	}
+	return value, true
+}
+
+// Signed session cookie with attributes from config. Scripts can not read it.
+func NewSessionCookie(appConfig *AppConfig, sessionId string, expires time.Time) *http.Cookie {
+	return newSignedCookie(appConfig, SessionCookieName, sessionId, expires)
+}
+
+// Cookie removing session cookie from browser.
+func ExpiredSessionCookie(appConfig *AppConfig) *http.Cookie {
+	cookie := newSignedCookie(appConfig, SessionCookieName, "", time.Unix(0, 0))
+	cookie.Value = ""
+	cookie.MaxAge = -1
+	return cookie
+}
+
+// Signed cookie with CSRF token of anonymous visitor (double-submit: forms send the same token).
+// It lives until browser is closed, so anonymous visitors need no session in redis.
+func NewCsrfCookie(appConfig *AppConfig, token string) *http.Cookie {
+	return newSignedCookie(appConfig, CsrfCookieName, token, time.Time{})
+}
+
+// CSRF token from signed cookie of request. Return "" if there is no valid cookie.
+func RequestCsrfToken(appConfig *AppConfig, r *http.Request) string {
+	return requestSignedCookie(appConfig, r, CsrfCookieName)
+}
+
+// Does form contain CSRF token of session (or of CSRF cookie for anonymous visitor).
+func CheckCsrfToken(appConfig *AppConfig, r *http.Request, session *SessionData) bool {
+	expected := session.CsrfToken
+	if session.Login == "" {
+		expected = RequestCsrfToken(appConfig, r)
+	}
+	token := r.PostFormValue("csrfToken")
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func newSignedCookie(appConfig *AppConfig, name string, value string, expires time.Time) *http.Cookie {
+	sameSite := http.SameSiteLaxMode
+	switch appConfig.CookieSameSite {
+	case "Strict":
+		sameSite = http.SameSiteStrictMode
+	case "None":
+		sameSite = http.SameSiteNoneMode
+	}
+	return &http.Cookie{
+		Name:     name,
+		Value:    SignCookieValue(appConfig, value),
+		Path:     "/",
+		Domain:   appConfig.CookieDomain,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   appConfig.CookieSecure,
+		SameSite: sameSite,
+	}
+}
+
+// Session id from signed session cookie of request. Return "" if there is no valid cookie.
+func RequestSessionId(appConfig *AppConfig, r *http.Request) string {
+	return requestSignedCookie(appConfig, r, SessionCookieName)
+}
+
+func requestSignedCookie(appConfig *AppConfig, r *http.Request, name string) string {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	value, ok := VerifyCookieValue(appConfig, cookie.Value)
+	if !ok {
+		return ""
+	}
+	return value
+}
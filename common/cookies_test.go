@@ -0,0 +1,89 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var testCookieConfig = &AppConfig{CookieSecret: strings.Repeat("s", minSecretLength)}
+
+func TestSignedCookieValue(t *testing.T) {
+	signed := SignCookieValue(testCookieConfig, "session.id")
+	if value, ok := VerifyCookieValue(testCookieConfig, signed); !ok || value != "session.id" {
+		t.Errorf("signed value is verified as %q, %v", value, ok)
+	}
+
+	otherConfig := &AppConfig{CookieSecret: strings.Repeat("o", minSecretLength)}
+	forged := []string{
+		"",
+		"session.id",
+		"other" + signed[strings.LastIndex(signed, "."):],
+		signed + "x",
+		SignCookieValue(otherConfig, "session.id"),
+	}
+	for _, value := range forged {
+		if _, ok := VerifyCookieValue(testCookieConfig, value); ok {
+			t.Errorf("%q is verified", value)
+		}
+	}
+}
+
+// POST form request with csrfToken field and CSRF cookie (if cookieValue is not empty).
+func csrfRequest(token string, cookieValue string) *http.Request {
+	form := url.Values{"csrfToken": {token}}
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookieValue != "" {
+		r.AddCookie(&http.Cookie{Name: CsrfCookieName, Value: cookieValue})
+	}
+	return r
+}
+
+func TestCheckCsrfToken(t *testing.T) {
+	signed := NewCsrfCookie(testCookieConfig, "token").Value
+	user := &SessionData{Login: "user", CsrfToken: "token"}
+	cases := []struct {
+		name    string
+		session *SessionData
+		request *http.Request
+		ok      bool
+	}{
+		{"user", user, csrfRequest("token", ""), true},
+		{"user, wrong token", user, csrfRequest("other", ""), false},
+		{"user, no token", user, csrfRequest("", ""), false},
+		{"user without token", &SessionData{Login: "user"}, csrfRequest("", ""), false},
+		// Logged in user does not use cookie.
+		{"user, cookie only", &SessionData{Login: "user"}, csrfRequest("token", signed), false},
+		{"anonymous", &SessionData{}, csrfRequest("token", signed), true},
+		{"anonymous, wrong token", &SessionData{}, csrfRequest("other", signed), false},
+		{"anonymous, no cookie", &SessionData{}, csrfRequest("token", ""), false},
+		{"anonymous, unsigned cookie", &SessionData{}, csrfRequest("token", "token"), false},
+		{"anonymous, no token", &SessionData{}, csrfRequest("", SignCookieValue(testCookieConfig, "")), false},
+	}
+	for _, c := range cases {
+		if got := CheckCsrfToken(testCookieConfig, c.request, c.session); got != c.ok {
+			t.Errorf("%s: CheckCsrfToken is %v, want %v", c.name, got, c.ok)
+		}
+	}
+}
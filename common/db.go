@@ -26,16 +26,31 @@ import (
 )
 
 type UserData struct {
+	// Login as user typed it on registration. User key is normalized login (see NormalizeLogin).
 	Login        string
 	PasswordHash string
+	// See PasswordHasher. Empty for users registered before it was recorded (they have bcrypt hashes).
+	PasswordAlgorithm string
 }
 
 type SessionData struct {
 	Login            string
 	Id               string
 	ValidationErrors map[string]string
+	// Unix time session was created. Session expires SessionMaxAgeSeconds after that, even if it is used.
+	CreatedAt int64
+	// Token forms of this session should send back (protection from CSRF).
+	CsrfToken string
 }
 
+// Default session lifetimes (see AppConfig).
+const (
+	defaultSessionIdleSeconds   = 7 * 24 * 60 * 60
+	defaultSessionMaxAgeSeconds = 30 * 24 * 60 * 60
+	// Anonymous session holds only validation errors of last form, they are not needed for long.
+	anonymousSessionSeconds = 10 * 60
+)
+
 // Load data from redis.
 func RedisLoad(rdb *redis.Client, entity string, key string, rec interface{}) error {
 	rawVal, err := rdb.Get(entity + ":" + key).Result()
@@ -51,14 +66,14 @@ func RedisLoad(rdb *redis.Client, entity string, key string, rec interface{}) er
 	return nil
 }
 
-// Store data into redis.
-func RedisStore(rdb *redis.Client, entity string, key string, rec interface{}) error {
+// Store data into redis. Record expires after `ttl' (0 for no expiry).
+func RedisStore(rdb *redis.Client, entity string, key string, rec interface{}, ttl time.Duration) error {
 	rawVal, err := json.Marshal(rec)
 	if err != nil {
 		return err
 	}
 
-	err = rdb.Set(entity+":"+key, rawVal, 0).Err()
+	err = rdb.Set(entity+":"+key, rawVal, ttl).Err()
 	if err != nil {
 		return err
 	}
@@ -66,9 +81,30 @@ func RedisStore(rdb *redis.Client, entity string, key string, rec interface{}) e
 	return nil
 }
 
+// Rename KEYS[1] to KEYS[2] unless KEYS[2] exists. Used by migrations which may run in several
+// processes at once. Return 1 if renamed, 0 if KEYS[2] exists and -1 if KEYS[1] is already gone.
+var renameIfAbsentScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return -1
+end
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return 0
+end
+redis.call("RENAME", KEYS[1], KEYS[2])
+return 1
+`)
+
+// Rename key unless new key exists. Return false if it does (key already renamed by other
+// process is not a collision).
+func renameIfAbsent(rdb *redis.Client, key string, newKey string) (bool, error) {
+	renamed, err := renameIfAbsentScript.Run(rdb, []string{key, newKey}).Int()
+	return renamed != 0, err
+}
+
+// Find user by login in any case (see NormalizeLogin).
 func GetUserByLogin(rdb *redis.Client, login string) (*UserData, error) {
 	var rec UserData
-	err := RedisLoad(rdb, "User", login, &rec)
+	err := RedisLoad(rdb, "User", NormalizeLogin(login), &rec)
 	if err == redis.Nil {
 		return nil, nil
 	}
@@ -79,8 +115,9 @@ func GetUserByLogin(rdb *redis.Client, login string) (*UserData, error) {
 	return &rec, nil
 }
 
+// Save existing user. New users are stored with CreateUser.
 func StoreUser(rdb *redis.Client, user *UserData) error {
-	return RedisStore(rdb, "User", user.Login, user)
+	return RedisStore(rdb, "User", NormalizeLogin(user.Login), user, 0)
 }
 
 func GetSessionBySessionId(rdb *redis.Client, sessionId string) (*SessionData, error) {
@@ -96,23 +133,69 @@ func GetSessionBySessionId(rdb *redis.Client, sessionId string) (*SessionData, e
 	return &rec, nil
 }
 
-func StoreSession(rdb *redis.Client, session *SessionData) error {
-	return RedisStore(rdb, "Session", session.Id, session)
+// Does session hold anything worth storing.
+func (s *SessionData) IsEmpty() bool {
+	return s.Login == "" && len(s.ValidationErrors) == 0 && s.CsrfToken == ""
 }
 
-// Check cooldown for user session.
+// Time session is valid for from now: it expires after SessionIdleSeconds of inactivity
+// and SessionMaxAgeSeconds after creation. Not positive if session has expired.
+func SessionTTL(appConfig *AppConfig, session *SessionData) time.Duration {
+	idleSeconds := appConfig.SessionIdleSeconds
+	if idleSeconds <= 0 {
+		idleSeconds = defaultSessionIdleSeconds
+	}
+	if session.Login == "" && idleSeconds > anonymousSessionSeconds {
+		idleSeconds = anonymousSessionSeconds
+	}
+	ttl := time.Duration(idleSeconds) * time.Second
+	if untilMaxAge := time.Until(SessionExpiry(appConfig, session)); untilMaxAge < ttl {
+		ttl = untilMaxAge
+	}
+	return ttl
+}
+
+// Time session expires at even if it is used.
+func SessionExpiry(appConfig *AppConfig, session *SessionData) time.Time {
+	maxAgeSeconds := appConfig.SessionMaxAgeSeconds
+	if maxAgeSeconds <= 0 {
+		maxAgeSeconds = defaultSessionMaxAgeSeconds
+	}
+	return time.Unix(session.CreatedAt+int64(maxAgeSeconds), 0)
+}
+
+// Store session and prolong it (see SessionTTL). Expired session is deleted.
+func StoreSession(rdb *redis.Client, appConfig *AppConfig, session *SessionData) error {
+	ttl := SessionTTL(appConfig, session)
+	if ttl <= 0 {
+		return DeleteSession(rdb, session.Id)
+	}
+	return RedisStore(rdb, "Session", session.Id, session, ttl)
+}
+
+func DeleteSession(rdb *redis.Client, sessionId string) error {
+	return rdb.Del("Session:" + sessionId).Err()
+}
+
+// Cooldowns are separate for each canvas and belong to user, not to session:
+// logging in again (which gives new session) does not reset them.
+func cooldownKey(canvas string, login string) string {
+	return "Cooldown:" + canvas + ":" + NormalizeLogin(login)
+}
+
+// Check cooldown of user on given canvas.
 // Return true if there was cooldown info (user made request less than `CooldownSeconds' seconds ago).
 // Otherwise return false AND add cooldown info.
 // Should be atomic.
-func TestAndUpdateSessionCooldown(rdb *redis.Client, appConfig *AppConfig, sessionId string) (error, bool) {
+func TestAndUpdateUserCooldown(rdb *redis.Client, canvasConfig *CanvasConfig, login string) (error, bool) {
 	// Unfortunately, GETSET command has no TTL. Also there is no test-and-set command.
 	// So we do this:
 	// x = GETSET token, expireTime      # get old cooldown record and store new one.
 	// if x is present and x > now:      # there was cooldown info. User is too fast.
 	//   SET token x 					 # Set old cooldown info back.
-	key := "Cooldown:" + sessionId
+	key := cooldownKey(canvasConfig.Name, login)
 	currentTime := time.Now().Unix()
-	cooldownSec := int64(appConfig.CooldownSeconds)
+	cooldownSec := int64(canvasConfig.CooldownSeconds)
 	cooldownAsTime := time.Duration(cooldownSec) * time.Second
 	expirySec := currentTime + cooldownSec
 
@@ -140,8 +223,13 @@ func TestAndUpdateSessionCooldown(rdb *redis.Client, appConfig *AppConfig, sessi
 	return nil, false
 }
 
-func GetSessionCooldownBySessionId(rdb *redis.Client, sessionId string) (int, error) {
-	key := "Cooldown:" + sessionId
+// Remove cooldown of user on given canvas. Used when placement which started cooldown has failed.
+func ClearUserCooldown(rdb *redis.Client, canvas string, login string) error {
+	return rdb.Del(cooldownKey(canvas, login)).Err()
+}
+
+func GetUserCooldown(rdb *redis.Client, canvas string, login string) (int, error) {
+	key := cooldownKey(canvas, login)
 	currentTime := time.Now().Unix()
 
 	expiryStr, err := rdb.Get(key).Result()
@@ -162,3 +250,73 @@ func GetSessionCooldownBySessionId(rdb *redis.Client, sessionId string) (int, er
 
 	return int(cooldown), nil
 }
+
+// Saved state of canvas part managed by one ws_server instance.
+type CanvasSnapshot struct {
+	// Canvas name (see CanvasConfig).
+	Canvas string
+	// Color codes of pixels belonging to instance (see InstanceLayout).
+	ColorCodes []byte
+	// Canvas layout the snapshot was made for.
+	Layout         CanvasLayout
+	InstanceNumber int
+	// Version of shard map with Layout (see ShardMap).
+	MapVersion int64
+	// Id of last placement included into snapshot (see PlacementEvent).
+	LastPlacementId string
+	// Unix timestamp of snapshot.
+	CreatedAt int64
+}
+
+func snapshotKey(canvas string, instanceNumber int) string {
+	return "Snapshot:" + canvas + ":" + strconv.Itoa(instanceNumber)
+}
+
+func GetCanvasSnapshot(rdb *redis.Client, canvas string, instanceNumber int) (*CanvasSnapshot, error) {
+	var rec CanvasSnapshot
+	err := RedisLoad(rdb, "Snapshot", canvas+":"+strconv.Itoa(instanceNumber), &rec)
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+// Keeps stored snapshot if it includes placements newer than ARGV[3] (stream ids are "<ms>-<seq>").
+var storeCanvasSnapshotScript = redis.NewScript(fencePrelude + `
+local function parseId(id)
+	local ms, seq = string.match(id or "", "^(%d+)-(%d+)$")
+	return tonumber(ms) or 0, tonumber(seq) or 0
+end
+local current = redis.call("GET", KEYS[2])
+if current then
+	local currentMs, currentSeq = parseId(cjson.decode(current).LastPlacementId)
+	local ms, seq = parseId(ARGV[3])
+	if currentMs > ms or (currentMs == ms and currentSeq > seq) then
+		return 0
+	end
+end
+redis.call("SET", KEYS[2], ARGV[2])
+return 1
+`)
+
+// Save snapshot unless shard map has changed since snapshot.MapVersion (then return ErrShardMapChanged).
+// Newer stored snapshot is kept, so instance which lost its shard cannot roll checkpoint back
+// past placements already trimmed from log.
+func StoreCanvasSnapshot(rdb *redis.Client, snapshot *CanvasSnapshot) error {
+	rawSnapshot, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	err = storeCanvasSnapshotScript.Run(
+		rdb,
+		[]string{shardMapKey(snapshot.Canvas), snapshotKey(snapshot.Canvas, snapshot.InstanceNumber)},
+		snapshot.MapVersion,
+		rawSnapshot,
+		snapshot.LastPlacementId,
+	).Err()
+	return fenceError(err)
+}
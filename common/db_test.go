@@ -0,0 +1,91 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionTTL(t *testing.T) {
+	now := time.Now().Unix()
+	config := &AppConfig{SessionIdleSeconds: 3600, SessionMaxAgeSeconds: 7200}
+	cases := []struct {
+		name    string
+		config  *AppConfig
+		session SessionData
+		want    time.Duration
+	}{
+		{"defaults", &AppConfig{}, SessionData{Login: "user", CreatedAt: now}, defaultSessionIdleSeconds * time.Second},
+		{"anonymous", &AppConfig{}, SessionData{CreatedAt: now}, anonymousSessionSeconds * time.Second},
+		{"idle timeout", config, SessionData{Login: "user", CreatedAt: now - 1800}, time.Hour},
+		{"max age is near", config, SessionData{Login: "user", CreatedAt: now - 5400}, 30 * time.Minute},
+		{"expired", config, SessionData{Login: "user", CreatedAt: now - 7200}, 0},
+		{"long expired", config, SessionData{Login: "user", CreatedAt: now - 100000}, -(100000 - 7200) * time.Second},
+	}
+	for _, c := range cases {
+		// Time passes while test runs, expiry is in whole seconds.
+		got := SessionTTL(c.config, &c.session)
+		if got > c.want+time.Second || got < c.want-2*time.Second {
+			t.Errorf("%s: TTL is %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	session := &SessionData{Login: "user", CreatedAt: 1000}
+	if got := SessionExpiry(&AppConfig{SessionMaxAgeSeconds: 60}, session); got.Unix() != 1060 {
+		t.Errorf("expiry is %d, want 1060", got.Unix())
+	}
+	if got := SessionExpiry(&AppConfig{}, session); got.Unix() != 1000+defaultSessionMaxAgeSeconds {
+		t.Errorf("default expiry is %d, want %d", got.Unix(), 1000+defaultSessionMaxAgeSeconds)
+	}
+}
+
+// Checkpoint is restored only if its layout equals current one, so layout has to survive JSON.
+func TestCanvasSnapshotJSON(t *testing.T) {
+	layout := MustNewCanvasLayout(&CanvasConfig{
+		CanvasCols:  10,
+		CanvasRows:  6,
+		ChunkSize:   4,
+		ChunkOwners: map[string]int{"1:1": 0},
+	}, 2)
+	snapshot := CanvasSnapshot{
+		Canvas:          "main",
+		ColorCodes:      []byte{0, 1, 2, 255},
+		Layout:          *layout,
+		InstanceNumber:  1,
+		MapVersion:      3,
+		LastPlacementId: "1000-1",
+		CreatedAt:       1500,
+	}
+	raw, err := json.Marshal(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored CanvasSnapshot
+	if err := json.Unmarshal(raw, &restored); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored, snapshot) || !restored.Layout.Equal(layout) {
+		t.Errorf("snapshot is %+v after JSON, want %+v", restored, snapshot)
+	}
+}
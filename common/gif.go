@@ -0,0 +1,149 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bufio"
+	"compress/lzw"
+	"encoding/binary"
+	"image/color"
+	"io"
+)
+
+// GIF stores width and height in 16 bits.
+const MaxGifSide = 65535
+
+// Animated GIF encoder writing frames as they are made. Timelapse may have hundreds of full size
+// frames, so they are streamed to response one by one and only the current frame is kept in memory.
+// That is why image/gif is not used: gif.EncodeAll needs every frame in memory at once.
+// All frames are full size and use global palette. Width and height should not exceed MaxGifSide.
+type GifStreamWriter struct {
+	w *bufio.Writer
+	// Number of bits per color index.
+	bits          int
+	width, height int
+	headerWritten bool
+	palette       color.Palette
+}
+
+// Make encoder writing GIF of given size into w. Palette should have at most 256 colors.
+func NewGifStreamWriter(w io.Writer, width, height int, palette color.Palette) *GifStreamWriter {
+	bits := 1
+	for 1<<uint(bits) < len(palette) {
+		bits++
+	}
+	return &GifStreamWriter{
+		w:       bufio.NewWriter(w),
+		bits:    bits,
+		width:   width,
+		height:  height,
+		palette: palette,
+	}
+}
+
+func (g *GifStreamWriter) writeHeader() {
+	g.w.WriteString("GIF89a")
+	var screen [7]byte
+	binary.LittleEndian.PutUint16(screen[0:2], uint16(g.width))
+	binary.LittleEndian.PutUint16(screen[2:4], uint16(g.height))
+	// Global color table with 2^bits colors.
+	screen[4] = 0x80 | byte(g.bits-1)<<4 | byte(g.bits-1)
+	g.w.Write(screen[:])
+	for i := 0; i < 1<<uint(g.bits); i++ {
+		var r, gr, b uint32
+		if i < len(g.palette) {
+			r, gr, b, _ = g.palette[i].RGBA()
+		}
+		g.w.Write([]byte{byte(r >> 8), byte(gr >> 8), byte(b >> 8)})
+	}
+	// Loop forever.
+	g.w.Write([]byte{0x21, 0xff, 0x0b})
+	g.w.WriteString("NETSCAPE2.0")
+	g.w.Write([]byte{0x03, 0x01, 0x00, 0x00, 0x00})
+}
+
+// Write frame with given delay (in 100ths of a second). Pixels are color indices written
+// by `pixels' row by row.
+func (g *GifStreamWriter) WriteFrame(delay int, pixels func(w io.Writer) error) error {
+	if !g.headerWritten {
+		g.writeHeader()
+		g.headerWritten = true
+	}
+
+	g.w.Write([]byte{0x21, 0xf9, 0x04, 0x00, byte(delay), byte(delay >> 8), 0x00, 0x00})
+	var descriptor [10]byte
+	descriptor[0] = 0x2c
+	binary.LittleEndian.PutUint16(descriptor[5:7], uint16(g.width))
+	binary.LittleEndian.PutUint16(descriptor[7:9], uint16(g.height))
+	g.w.Write(descriptor[:])
+
+	litWidth := g.bits
+	if litWidth < 2 {
+		litWidth = 2
+	}
+	g.w.WriteByte(byte(litWidth))
+	blocks := &gifBlockWriter{w: g.w}
+	lw := lzw.NewWriter(blocks, lzw.LSB, litWidth)
+	if err := pixels(lw); err != nil {
+		return err
+	}
+	if err := lw.Close(); err != nil {
+		return err
+	}
+	blocks.flush()
+	g.w.WriteByte(0x00)
+	return g.w.Flush()
+}
+
+// Finish GIF. Nothing is written after that.
+func (g *GifStreamWriter) Close() error {
+	if !g.headerWritten {
+		g.writeHeader()
+		g.headerWritten = true
+	}
+	g.w.WriteByte(0x3b)
+	return g.w.Flush()
+}
+
+// Splits image data into GIF sub-blocks of at most 255 bytes.
+type gifBlockWriter struct {
+	w   *bufio.Writer
+	buf [256]byte
+	n   int
+}
+
+func (b *gifBlockWriter) Write(data []byte) (int, error) {
+	for i := range data {
+		b.buf[1+b.n] = data[i]
+		b.n++
+		if b.n == 255 {
+			b.flush()
+		}
+	}
+	return len(data), nil
+}
+
+func (b *gifBlockWriter) flush() {
+	if b.n == 0 {
+		return
+	}
+	b.buf[0] = byte(b.n)
+	b.w.Write(b.buf[:1+b.n])
+	b.n = 0
+}
@@ -0,0 +1,102 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bytes"
+	"image/gif"
+	"io"
+	"testing"
+)
+
+func TestGifStreamWriterDecodes(t *testing.T) {
+	cases := []struct {
+		name          string
+		colors        []string
+		width, height int
+		frames        int
+	}{
+		{"two colors", []string{"black", "white"}, 3, 2, 2},
+		{"six colors", []string{"black", "white", "red", "lime", "blue", "yellow"}, 5, 3, 3},
+		// Frame data spans many 255 byte sub-blocks.
+		{"sixteen colors, large frames", []string{
+			"gray", "black", "maroon", "red", "green", "lime", "olive", "yellow",
+			"navy", "blue", "purple", "fuchsia", "teal", "aqua", "silver", "white",
+		}, 300, 200, 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			palette := MakePalette(c.colors)
+			frames := make([][]byte, c.frames)
+			for f := range frames {
+				frames[f] = make([]byte, c.width*c.height)
+				for i := range frames[f] {
+					frames[f][i] = byte((i*7 + i/c.width + f*3) % len(palette))
+				}
+			}
+
+			var buf bytes.Buffer
+			gw := NewGifStreamWriter(&buf, c.width, c.height, palette)
+			for f, frame := range frames {
+				err := gw.WriteFrame(f+1, func(w io.Writer) error {
+					_, err := w.Write(frame)
+					return err
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := gw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := gif.DecodeAll(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Config.Width != c.width || decoded.Config.Height != c.height {
+				t.Fatalf("size is %dx%d, want %dx%d",
+					decoded.Config.Width, decoded.Config.Height, c.width, c.height)
+			}
+			if decoded.LoopCount != 0 {
+				t.Errorf("loop count is %d, want 0 (forever)", decoded.LoopCount)
+			}
+			if len(decoded.Image) != len(frames) {
+				t.Fatalf("got %d frames, want %d", len(decoded.Image), len(frames))
+			}
+			for f, img := range decoded.Image {
+				if decoded.Delay[f] != f+1 {
+					t.Errorf("frame %d: delay is %d, want %d", f, decoded.Delay[f], f+1)
+				}
+				for i, want := range palette {
+					if img.Palette[i] != want {
+						t.Errorf("frame %d: palette color %d is %v, want %v", f, i, img.Palette[i], want)
+					}
+				}
+				if img.Rect.Dx() != c.width || img.Rect.Dy() != c.height || img.Stride != c.width {
+					t.Fatalf("frame %d: bounds are %v with stride %d", f, img.Rect, img.Stride)
+				}
+				if !bytes.Equal(img.Pix, frames[f]) {
+					t.Errorf("frame %d: pixels differ from input canvas", f)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"fmt"
+	"image"
+)
+
+// Default size of canvas chunk side in pixels.
+const defaultChunkSize = 32
+
+// Partition of canvas into square chunks and assignment of chunks to ws_server instances.
+// Chunks are numbered row by row: chunk = chunkY * ChunksX + chunkX.
+type CanvasLayout struct {
+	Width     int
+	Height    int
+	ChunkSize int
+	ChunksX   int
+	ChunksY   int
+	// Number of instances canvas is split between.
+	Shards int
+	// Owner instance of each chunk.
+	Owners []int
+}
+
+// Build layout from canvas config. Chunks missing in ChunkOwners are assigned round-robin.
+func NewCanvasLayout(canvasConfig *CanvasConfig, totalInstances int) (*CanvasLayout, error) {
+	chunkSize := canvasConfig.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	l := CanvasLayout{
+		Width:     canvasConfig.CanvasCols,
+		Height:    canvasConfig.CanvasRows,
+		ChunkSize: chunkSize,
+		ChunksX:   (canvasConfig.CanvasCols + chunkSize - 1) / chunkSize,
+		ChunksY:   (canvasConfig.CanvasRows + chunkSize - 1) / chunkSize,
+		Shards:    totalInstances,
+	}
+	l.Owners = make([]int, l.ChunksX*l.ChunksY)
+	for chunk := range l.Owners {
+		l.Owners[chunk] = chunk % totalInstances
+	}
+
+	for key, owner := range canvasConfig.ChunkOwners {
+		var chunkX, chunkY int
+		if _, err := fmt.Sscanf(key, "%d:%d", &chunkX, &chunkY); err != nil {
+			return nil, fmt.Errorf("canvas %s: bad chunk %q, expected \"x:y\"", canvasConfig.Name, key)
+		}
+		if chunkX < 0 || chunkX >= l.ChunksX || chunkY < 0 || chunkY >= l.ChunksY {
+			return nil, fmt.Errorf("canvas %s: chunk %q is outside of canvas", canvasConfig.Name, key)
+		}
+		if owner < 0 || owner >= totalInstances {
+			return nil, fmt.Errorf("canvas %s: chunk %q has bad owner %d", canvasConfig.Name, key, owner)
+		}
+		l.Owners[chunkY*l.ChunksX+chunkX] = owner
+	}
+
+	return &l, nil
+}
+
+// Same as NewCanvasLayout. Panic on error.
+func MustNewCanvasLayout(canvasConfig *CanvasConfig, totalInstances int) *CanvasLayout {
+	l, err := NewCanvasLayout(canvasConfig, totalInstances)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// Index of chunk containing pixel (x, y). Return -1 for pixels outside of canvas.
+func (l *CanvasLayout) ChunkAt(x, y int) int {
+	if x < 0 || x >= l.Width || y < 0 || y >= l.Height {
+		return -1
+	}
+	return (y/l.ChunkSize)*l.ChunksX + x/l.ChunkSize
+}
+
+// Instance owning pixel (x, y). Return -1 for pixels outside of canvas.
+func (l *CanvasLayout) Owner(x, y int) int {
+	chunk := l.ChunkAt(x, y)
+	if chunk < 0 {
+		return -1
+	}
+	return l.Owners[chunk]
+}
+
+// Pixels covered by chunk (clipped by canvas borders).
+func (l *CanvasLayout) ChunkRect(chunk int) image.Rectangle {
+	x := (chunk % l.ChunksX) * l.ChunkSize
+	y := (chunk / l.ChunksX) * l.ChunkSize
+	return image.Rect(x, y, x+l.ChunkSize, y+l.ChunkSize).Intersect(image.Rect(0, 0, l.Width, l.Height))
+}
+
+// Chunks owned by instance in ascending order.
+func (l *CanvasLayout) InstanceChunks(instance int) []int {
+	chunks := make([]int, 0)
+	for chunk, owner := range l.Owners {
+		if owner == instance {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// Placement of pixels in data of one instance.
+// Instance data is a sequence of its chunks (see InstanceChunks), each chunk is
+// ChunkSize * ChunkSize color codes row by row (chunks on canvas border are padded).
+type InstanceLayout struct {
+	*CanvasLayout
+	Instance int
+	// Position of each chunk in instance data. -1 for chunks of other instances.
+	slots     []int
+	numChunks int
+}
+
+func (l *CanvasLayout) ForInstance(instance int) *InstanceLayout {
+	il := InstanceLayout{
+		CanvasLayout: l,
+		Instance:     instance,
+		slots:        make([]int, len(l.Owners)),
+	}
+	for chunk, owner := range l.Owners {
+		if owner == instance {
+			il.slots[chunk] = il.numChunks
+			il.numChunks++
+		} else {
+			il.slots[chunk] = -1
+		}
+	}
+	return &il
+}
+
+// Position of pixel (x, y) in instance data. Return -1 if pixel belongs to other instance.
+func (il *InstanceLayout) Index(x, y int) int {
+	chunk := il.ChunkAt(x, y)
+	if chunk < 0 || il.slots[chunk] < 0 {
+		return -1
+	}
+	localX := x % il.ChunkSize
+	localY := y % il.ChunkSize
+	return il.slots[chunk]*il.ChunkSize*il.ChunkSize + localY*il.ChunkSize + localX
+}
+
+// Number of color codes in instance data.
+func (il *InstanceLayout) DataSize() int {
+	return il.numChunks * il.ChunkSize * il.ChunkSize
+}
+
+// Are layouts the same.
+func (l *CanvasLayout) Equal(other *CanvasLayout) bool {
+	if l.Width != other.Width || l.Height != other.Height || l.ChunkSize != other.ChunkSize ||
+		l.Shards != other.Shards || len(l.Owners) != len(other.Owners) {
+		return false
+	}
+	for i := range l.Owners {
+		if l.Owners[i] != other.Owners[i] {
+			return false
+		}
+	}
+	return true
+}
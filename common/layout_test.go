@@ -0,0 +1,143 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"testing"
+)
+
+func TestNewCanvasLayout(t *testing.T) {
+	// 5x3 chunks of 4 pixels, last column and row are clipped.
+	l, err := NewCanvasLayout(&CanvasConfig{
+		Name:        "test",
+		CanvasCols:  18,
+		CanvasRows:  10,
+		ChunkSize:   4,
+		ChunkOwners: map[string]int{"4:2": 0},
+	}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.ChunksX != 5 || l.ChunksY != 3 {
+		t.Fatalf("chunks are %dx%d, want 5x3", l.ChunksX, l.ChunksY)
+	}
+	wantOwners := []int{
+		0, 1, 2, 0, 1,
+		2, 0, 1, 2, 0,
+		1, 2, 0, 1, 0,
+	}
+	for chunk, want := range wantOwners {
+		if l.Owners[chunk] != want {
+			t.Errorf("chunk %d: owner is %d, want %d", chunk, l.Owners[chunk], want)
+		}
+	}
+
+	badOwners := []map[string]int{
+		{"5:0": 0},
+		{"0:3": 0},
+		{"-1:0": 0},
+		{"0:0": 3},
+		{"0:0": -1},
+		{"x": 0},
+	}
+	for _, owners := range badOwners {
+		_, err := NewCanvasLayout(&CanvasConfig{CanvasCols: 18, CanvasRows: 10, ChunkSize: 4, ChunkOwners: owners}, 3)
+		if err == nil {
+			t.Errorf("ChunkOwners %v: expected error", owners)
+		}
+	}
+}
+
+func TestInstanceLayoutIndex(t *testing.T) {
+	l := MustNewCanvasLayout(&CanvasConfig{CanvasCols: 10, CanvasRows: 7, ChunkSize: 4}, 2)
+	// Chunks (3x2): 0 1 0 / 1 0 1.
+	cases := []struct {
+		instance int
+		x, y     int
+		want     int
+	}{
+		// Instance 0 has chunks 0, 2, 4.
+		{0, 0, 0, 0},
+		{0, 3, 3, 15},
+		{0, 8, 0, 16},
+		{0, 9, 1, 16 + 5},
+		{0, 4, 4, 32},
+		{0, 7, 6, 32 + 2*4 + 3},
+		{0, 4, 0, -1},
+		{0, 0, 4, -1},
+		// Instance 1 has chunks 1, 3, 5. Chunk 5 is clipped to 2x3, it is padded in data.
+		{1, 4, 0, 0},
+		{1, 0, 4, 16},
+		{1, 8, 4, 32},
+		{1, 9, 6, 32 + 2*4 + 1},
+		{1, 0, 0, -1},
+		// Outside of canvas.
+		{0, -1, 0, -1},
+		{0, 10, 0, -1},
+		{0, 0, 7, -1},
+		{1, 0, -1, -1},
+	}
+	for _, c := range cases {
+		if got := l.ForInstance(c.instance).Index(c.x, c.y); got != c.want {
+			t.Errorf("instance %d: Index(%d, %d) is %d, want %d", c.instance, c.x, c.y, got, c.want)
+		}
+	}
+
+	for instance, want := range []int{3 * 16, 3 * 16, 0} {
+		if got := l.ForInstance(instance).DataSize(); got != want {
+			t.Errorf("instance %d: DataSize() is %d, want %d", instance, got, want)
+		}
+	}
+}
+
+func TestInstanceLayoutIndexIsUnique(t *testing.T) {
+	l := MustNewCanvasLayout(&CanvasConfig{
+		CanvasCols:  37,
+		CanvasRows:  21,
+		ChunkSize:   8,
+		ChunkOwners: map[string]int{"1:1": 2, "4:2": 2},
+	}, 3)
+	owners := 0
+	for instance := 0; instance < l.Shards; instance++ {
+		il := l.ForInstance(instance)
+		seen := make(map[int]bool)
+		for y := 0; y < l.Height; y++ {
+			for x := 0; x < l.Width; x++ {
+				i := il.Index(x, y)
+				if (i >= 0) != (l.Owner(x, y) == instance) {
+					t.Fatalf("instance %d: Index(%d, %d) is %d, but owner is %d", instance, x, y, i, l.Owner(x, y))
+				}
+				if i < 0 {
+					continue
+				}
+				owners++
+				if i >= il.DataSize() {
+					t.Fatalf("instance %d: Index(%d, %d) is %d, beyond DataSize() %d", instance, x, y, i, il.DataSize())
+				}
+				if seen[i] {
+					t.Fatalf("instance %d: Index(%d, %d) is %d, used by other pixel", instance, x, y, i)
+				}
+				seen[i] = true
+			}
+		}
+	}
+	if owners != l.Width*l.Height {
+		t.Errorf("%d pixels have owner, want %d", owners, l.Width*l.Height)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"github.com/go-redis/redis"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default brute-force protection settings (see AppConfig).
+const (
+	defaultLoginFreeAttempts         = 5
+	defaultLoginFreeAttemptsPerIP    = 20
+	defaultLoginLockBaseSeconds      = 30
+	defaultLoginLockMaxSeconds       = 60 * 60
+	defaultLoginFailureWindowSeconds = 60 * 60
+)
+
+// Failed logins are counted per login and per client IP.
+const (
+	LockoutByLogin = "login"
+	LockoutByIP    = "ip"
+)
+
+// Count failed attempt. Failures are forgotten `window' seconds after the last one.
+// KEYS: failures counter. ARGV: window.
+var registerLoginFailureScript = redis.NewScript(`
+local failures = redis.call("INCR", KEYS[1])
+redis.call("EXPIRE", KEYS[1], ARGV[1])
+return failures
+`)
+
+// Lock time after failures attempts: none for first `free' ones, then `base' seconds doubling
+// with every next failure, at most `max' seconds.
+func loginLockDuration(failures, free, base, max int) time.Duration {
+	extra := failures - free
+	if extra <= 0 {
+		return 0
+	}
+	lock := base
+	for i := 1; i < extra && lock < max; i++ {
+		lock *= 2
+	}
+	if lock > max {
+		lock = max
+	}
+	return time.Duration(lock) * time.Second
+}
+
+// Subject of lockout: login or client IP with its failed attempts.
+type LoginLockout struct {
+	Kind    string
+	Subject string
+	// Failed attempts during failure window.
+	Failures int
+	// Time left until subject may try again (0 if it is not locked).
+	LockedFor time.Duration
+}
+
+func loginFailuresKey(kind, subject string) string {
+	return "LoginFailures:" + kind + ":" + subject
+}
+
+func loginLockKey(kind, subject string) string {
+	return "LoginLock:" + kind + ":" + subject
+}
+
+func intOrDefault(val, defaultVal int) int {
+	if val <= 0 {
+		return defaultVal
+	}
+	return val
+}
+
+// Locks which apply to login attempt for login from ip.
+type LoginLockState struct {
+	LoginLockedFor time.Duration
+	IPLockedFor    time.Duration
+	// Failed attempts from ip (for any login) during failure window.
+	IPFailures int
+}
+
+func GetLoginLockState(rdb *redis.Client, login string, ip string) (*LoginLockState, error) {
+	var loginTTL, ipTTL *redis.DurationCmd
+	var ipFailures *redis.StringCmd
+	_, err := rdb.Pipelined(func(pipe redis.Pipeliner) error {
+		loginTTL = pipe.TTL(loginLockKey(LockoutByLogin, login))
+		ipTTL = pipe.TTL(loginLockKey(LockoutByIP, ip))
+		ipFailures = pipe.Get(loginFailuresKey(LockoutByIP, ip))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	state := LoginLockState{}
+	// TTL is negative if there is no lock.
+	if loginTTL.Val() > 0 {
+		state.LoginLockedFor = loginTTL.Val()
+	}
+	if ipTTL.Val() > 0 {
+		state.IPLockedFor = ipTTL.Val()
+	}
+	state.IPFailures, _ = strconv.Atoi(ipFailures.Val())
+	return &state, nil
+}
+
+// Time left until attempt is allowed. 0 if it is allowed now.
+// Login lock does not apply to IP without recent failures, so nobody can lock user out by failing
+// on purpose. Such IP gets one attempt, its failure is counted for login and IP as usual.
+func (s *LoginLockState) Remaining() time.Duration {
+	if s.IPFailures == 0 || s.IPLockedFor > s.LoginLockedFor {
+		return s.IPLockedFor
+	}
+	return s.LoginLockedFor
+}
+
+// Count failed login attempt for login and ip. Repeated failures lock them with exponential backoff.
+func RegisterLoginFailure(rdb *redis.Client, appConfig *AppConfig, login string, ip string) error {
+	window := intOrDefault(appConfig.LoginFailureWindowSeconds, defaultLoginFailureWindowSeconds)
+	base := intOrDefault(appConfig.LoginLockBaseSeconds, defaultLoginLockBaseSeconds)
+	max := intOrDefault(appConfig.LoginLockMaxSeconds, defaultLoginLockMaxSeconds)
+	subjects := []struct {
+		kind    string
+		subject string
+		free    int
+	}{
+		{LockoutByLogin, login, intOrDefault(appConfig.LoginFreeAttempts, defaultLoginFreeAttempts)},
+		{LockoutByIP, ip, intOrDefault(appConfig.LoginFreeAttemptsPerIP, defaultLoginFreeAttemptsPerIP)},
+	}
+	for _, s := range subjects {
+		failures, err := registerLoginFailureScript.Run(rdb, []string{loginFailuresKey(s.kind, s.subject)}, window).Int()
+		if err != nil {
+			return err
+		}
+		if lock := loginLockDuration(failures, s.free, base, max); lock > 0 {
+			if err := rdb.Set(loginLockKey(s.kind, s.subject), failures, lock).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Forget failed attempts and lock of login or ip.
+func ClearLoginFailures(rdb *redis.Client, kind string, subject string) error {
+	return rdb.Del(loginFailuresKey(kind, subject), loginLockKey(kind, subject)).Err()
+}
+
+// All logins and IPs with failed attempts, locked ones first.
+func ListLoginLockouts(rdb *redis.Client) ([]LoginLockout, error) {
+	lockouts := make([]LoginLockout, 0)
+	iter := rdb.Scan(0, "LoginFailures:*", 100).Iterator()
+	for iter.Next() {
+		parts := strings.SplitN(strings.TrimPrefix(iter.Val(), "LoginFailures:"), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		lockout := LoginLockout{Kind: parts[0], Subject: parts[1]}
+
+		failures, err := rdb.Get(iter.Val()).Result()
+		if err == redis.Nil {
+			// Expired while scanning.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		lockout.Failures, _ = strconv.Atoi(failures)
+		ttl, err := rdb.TTL(loginLockKey(lockout.Kind, lockout.Subject)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ttl > 0 {
+			lockout.LockedFor = ttl
+		}
+		lockouts = append(lockouts, lockout)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(lockouts, func(i, j int) bool {
+		return lockouts[i].LockedFor > lockouts[j].LockedFor
+	})
+	return lockouts, nil
+}
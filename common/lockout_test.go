@@ -0,0 +1,67 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginLockDuration(t *testing.T) {
+	cases := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{5, 0},
+		{6, 30 * time.Second},
+		{7, 60 * time.Second},
+		{9, 240 * time.Second},
+		{12, 1000 * time.Second},
+		{1000, 1000 * time.Second},
+	}
+	for _, c := range cases {
+		if got := loginLockDuration(c.failures, 5, 30, 1000); got != c.want {
+			t.Errorf("%d failures: lock is %v, want %v", c.failures, got, c.want)
+		}
+	}
+	if got := loginLockDuration(3, 0, 7, 5); got != 5*time.Second {
+		t.Errorf("base above max: lock is %v", got)
+	}
+}
+
+func TestLoginLockStateRemaining(t *testing.T) {
+	cases := []struct {
+		name  string
+		state LoginLockState
+		want  time.Duration
+	}{
+		{"nothing locked", LoginLockState{}, 0},
+		{"login locked, clean IP", LoginLockState{LoginLockedFor: time.Minute}, 0},
+		{"login locked, IP failed before", LoginLockState{LoginLockedFor: time.Minute, IPFailures: 1}, time.Minute},
+		{"IP locked", LoginLockState{IPLockedFor: time.Minute, IPFailures: 20}, time.Minute},
+		{"both locked", LoginLockState{LoginLockedFor: time.Hour, IPLockedFor: time.Minute, IPFailures: 20}, time.Hour},
+		{"IP locked longer", LoginLockState{LoginLockedFor: time.Minute, IPLockedFor: time.Hour, IPFailures: 20}, time.Hour},
+	}
+	for _, c := range cases {
+		if got := c.state.Remaining(); got != c.want {
+			t.Errorf("%s: remaining is %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Login length limits (in characters, after normalization).
+const (
+	MinLoginLength = 3
+	MaxLoginLength = 32
+)
+
+// Logins nobody can register (compared after normalization), in addition to ReservedLogins from config.
+var defaultReservedLogins = []string{
+	"admin", "administrator", "root", "system", "moderator", "support", "staff",
+	"server", "gateway", "anonymous", "null", "undefined",
+}
+
+var loginCaser = cases.Fold()
+
+// Script of character, "" for characters shared by scripts (ASCII digits, punctuation).
+// Japanese kana are written together with Han characters, so they count as Han.
+func scriptOf(r rune) string {
+	if unicode.In(r, unicode.Common, unicode.Inherited) {
+		return ""
+	}
+	if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) {
+		return "Han"
+	}
+	for name, table := range unicode.Scripts {
+		if unicode.Is(table, r) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Canonical form of login used as user key: NFKC with case folding, so "Alice", "ALICE"
+// and "Ａｌｉｃｅ" are the same user.
+func NormalizeLogin(login string) string {
+	return norm.NFKC.String(loginCaser.String(norm.NFKC.String(strings.TrimSpace(login))))
+}
+
+// Login as user typed it, cleaned up for display: NFKC without case folding.
+func DisplayLogin(login string) string {
+	return norm.NFKC.String(strings.TrimSpace(login))
+}
+
+// Check login for registration. Return message for user or "" if login is fine.
+func (c *AppConfig) ValidateLogin(login string) string {
+	normalized := NormalizeLogin(login)
+	if normalized == "" {
+		return "Login is empty"
+	}
+	length := utf8.RuneCountInString(normalized)
+	if length < MinLoginLength || length > MaxLoginLength {
+		return fmt.Sprintf("Login should be %d to %d characters long", MinLoginLength, MaxLoginLength)
+	}
+	// Letters of one script only, so login can not mix look-alike letters of different scripts
+	// (Cyrillic "а" in "аdmin") to pass for reserved or existing login.
+	loginScript := ""
+	for i, r := range normalized {
+		isAlnum := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if i == 0 && !isAlnum {
+			return "Login should start with letter or digit"
+		}
+		if !isAlnum && r != '_' && r != '-' && r != '.' {
+			return "Login may contain only letters, digits, \"_\", \"-\" and \".\""
+		}
+		if script := scriptOf(r); script != "" {
+			if loginScript != "" && script != loginScript {
+				return "Login may not mix letters of different alphabets"
+			}
+			loginScript = script
+		}
+	}
+	if c.IsReservedLogin(normalized) {
+		return "Login is reserved"
+	}
+	return ""
+}
+
+// Is login reserved (see ReservedLogins).
+func (c *AppConfig) IsReservedLogin(login string) bool {
+	normalized := NormalizeLogin(login)
+	for _, reserved := range defaultReservedLogins {
+		if reserved == normalized {
+			return true
+		}
+	}
+	for _, reserved := range c.ReservedLogins {
+		if NormalizeLogin(reserved) == normalized {
+			return true
+		}
+	}
+	return false
+}
+
+// Store new user atomically. Return false if user with same normalized login already exists.
+func CreateUser(rdb *redis.Client, user *UserData) (bool, error) {
+	rawVal, err := json.Marshal(user)
+	if err != nil {
+		return false, err
+	}
+	return rdb.SetNX("User:"+NormalizeLogin(user.Login), rawVal, 0).Result()
+}
+
+// Move users registered before logins were normalized from "User:<login>" to "User:<normalized login>".
+// Should be run before serving requests. Users whose normalized login is taken by other user are left
+// where they are (and can not log in), their keys are returned so admin can resolve collisions by hand.
+func MigrateUserKeys(rdb *redis.Client) ([]string, error) {
+	collisions := make([]string, 0)
+	iter := rdb.Scan(0, "User:*", 100).Iterator()
+	for iter.Next() {
+		key := iter.Val()
+		normalizedKey := "User:" + NormalizeLogin(strings.TrimPrefix(key, "User:"))
+		if key == normalizedKey {
+			continue
+		}
+		moved, err := renameIfAbsent(rdb, key, normalizedKey)
+		if err != nil {
+			return nil, err
+		}
+		if !moved {
+			collisions = append(collisions, key)
+		}
+	}
+	return collisions, iter.Err()
+}
@@ -0,0 +1,96 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"testing"
+)
+
+func TestNormalizeLogin(t *testing.T) {
+	cases := map[string]string{
+		"Alice":     "alice",
+		"  ALICE  ": "alice",
+		"Ａｌｉｃｅ":     "alice",
+		"Straße":    "strasse",
+		"STRASSE":   "strasse",
+		"ﬁsh":       "fish",
+		"Ωmega":     "ωmega",
+		"éclair":   "éclair",
+		"":          "",
+	}
+	for login, want := range cases {
+		if got := NormalizeLogin(login); got != want {
+			t.Errorf("NormalizeLogin(%q) is %q, want %q", login, got, want)
+		}
+	}
+}
+
+func TestValidateLogin(t *testing.T) {
+	appConfig := &AppConfig{ReservedLogins: []string{"Pixel_Bot"}}
+	cases := []struct {
+		login string
+		ok    bool
+	}{
+		{"alice", true},
+		{"Alice_99", true},
+		{"a.b-c", true},
+		{"007", true},
+		{"Иван", true},
+		{"ωμέγα", true},
+		{"山田たろう", true},
+		{"", false},
+		{"   ", false},
+		{"ab", false},
+		{"abcdefghijklmnopqrstuvwxyz1234567", false},
+		{"_alice", false},
+		{".alice", false},
+		{"al ice", false},
+		{"alice!", false},
+		{"ADMIN", false},
+		{"Ａｄｍｉｎ", false},
+		{"pixel_bot", false},
+		// Mixed scripts: Cyrillic "а", "о" in Latin logins.
+		{"аdmin", false},
+		{"rооt", false},
+		{"aliceа", false},
+		{"Иванivan", false},
+	}
+	for _, c := range cases {
+		message := appConfig.ValidateLogin(c.login)
+		if (message == "") != c.ok {
+			t.Errorf("ValidateLogin(%q) is %q", c.login, message)
+		}
+	}
+}
+
+func TestIsReservedLogin(t *testing.T) {
+	appConfig := &AppConfig{ReservedLogins: []string{"Pixel_Bot"}}
+	for login, want := range map[string]bool{
+		"admin":     true,
+		"Root":      true,
+		"ＲＯＯＴ":      true,
+		"PIXEL_BOT": true,
+		"alice":     false,
+		"admin1":    false,
+	} {
+		if got := appConfig.IsReservedLogin(login); got != want {
+			t.Errorf("IsReservedLogin(%q) is %v, want %v", login, got, want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// Password hashing algorithms (UserData.PasswordAlgorithm). Users without algorithm have bcrypt hashes.
+const (
+	PasswordBcrypt   = "bcrypt"
+	PasswordArgon2id = "argon2id"
+)
+
+// Default hashing costs and password policy (see AppConfig).
+const (
+	defaultBcryptCost         = bcrypt.DefaultCost
+	defaultArgon2Time         = 3
+	defaultArgon2MemoryKiB    = 64 * 1024
+	defaultArgon2Threads      = 2
+	defaultArgon2MaxMemoryKiB = 4 * defaultArgon2MemoryKiB
+	defaultPasswordMinLength  = 8
+
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+	// Longer passwords are rejected, hashing them is a waste of CPU.
+	maxPasswordBytes = 1024
+)
+
+// Passwords nobody can use, whatever the length.
+var commonPasswords = []string{
+	"password", "password1", "password123", "passw0rd", "12345678", "123456789", "1234567890",
+	"qwertyuiop", "qwerty123", "11111111", "00000000", "iloveyou", "sunshine", "princess",
+	"football", "baseball", "welcome1", "letmein1", "abc12345", "trustno1", "shittypixels",
+}
+
+var ErrBadPasswordHash = errors.New("bad password hash")
+
+// Algorithm making and checking password hashes.
+type PasswordHasher interface {
+	Algorithm() string
+	Hash(password string) (string, error)
+	Verify(password, hash string) (bool, error)
+	// Is hash made with other costs than hasher uses now.
+	NeedsRehash(hash string) bool
+	// Longest password hasher accepts, in bytes.
+	MaxPasswordBytes() int
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Algorithm() string {
+	return PasswordBcrypt
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(bytes), err
+}
+
+func (h *bcryptHasher) Verify(password, hash string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *bcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost
+}
+
+// bcrypt ignores everything after 72 bytes.
+func (h *bcryptHasher) MaxPasswordBytes() int {
+	return 72
+}
+
+// Argon2id costs: passes over memory, memory in KiB and number of threads.
+type argon2idCosts struct {
+	time      uint32
+	memoryKiB uint32
+	threads   uint8
+}
+
+// Hashes are stored in PHC string format: $argon2id$v=19$m=<KiB>,t=<time>,p=<threads>$<salt>$<key>.
+type argon2idHasher struct {
+	argon2idCosts
+	// Hashes asking for more memory are rejected, so a tampered hash can not make login allocate gigabytes.
+	maxMemoryKiB uint32
+}
+
+type argon2idHash struct {
+	argon2idCosts
+	salt []byte
+	key  []byte
+}
+
+func parseArgon2idHash(hash string, maxMemoryKiB uint32) (*argon2idHash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != PasswordArgon2id {
+		return nil, ErrBadPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, ErrBadPasswordHash
+	}
+	var h argon2idHash
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memoryKiB, &h.time, &h.threads)
+	if err != nil {
+		return nil, ErrBadPasswordHash
+	}
+	// Argon2 needs at least 8 KiB per thread.
+	if h.time < 1 || h.threads < 1 || h.memoryKiB < 8*uint32(h.threads) || h.memoryKiB > maxMemoryKiB {
+		return nil, ErrBadPasswordHash
+	}
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrBadPasswordHash
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, ErrBadPasswordHash
+	}
+	return &h, nil
+}
+
+func (h *argon2idHasher) Algorithm() string {
+	return PasswordArgon2id
+}
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memoryKiB, h.threads, argon2KeyLength)
+	return fmt.Sprintf(
+		"$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		PasswordArgon2id, argon2.Version, h.memoryKiB, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Hash is checked with costs it was made with, not with current ones.
+func (h *argon2idHasher) Verify(password, hash string) (bool, error) {
+	parsed, err := parseArgon2idHash(hash, h.maxMemoryKiB)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey(
+		[]byte(password), parsed.salt, parsed.time, parsed.memoryKiB, parsed.threads, uint32(len(parsed.key)))
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1, nil
+}
+
+func (h *argon2idHasher) NeedsRehash(hash string) bool {
+	parsed, err := parseArgon2idHash(hash, h.maxMemoryKiB)
+	return err != nil || parsed.argon2idCosts != h.argon2idCosts || len(parsed.key) != argon2KeyLength
+}
+
+func (h *argon2idHasher) MaxPasswordBytes() int {
+	return maxPasswordBytes
+}
+
+// Hashers of all supported algorithms. New hashes are made with the one chosen by PasswordHasher
+// setting, others are kept for checking hashes of users registered earlier.
+type Passwords struct {
+	current   PasswordHasher
+	hashers   map[string]PasswordHasher
+	minLength int
+	// Hash which is checked when user is not found, so response time does not tell if login exists.
+	dummyHash string
+}
+
+func NewPasswords(appConfig *AppConfig) (*Passwords, error) {
+	argon2Threads := intOrDefault(appConfig.Argon2Threads, defaultArgon2Threads)
+	if argon2Threads > 255 {
+		return nil, fmt.Errorf("Argon2Threads should be at most 255")
+	}
+	argon2MemoryKiB := intOrDefault(appConfig.Argon2MemoryKiB, defaultArgon2MemoryKiB)
+	argon2MaxMemoryKiB := intOrDefault(appConfig.Argon2MaxMemoryKiB, defaultArgon2MaxMemoryKiB)
+	if argon2MaxMemoryKiB < argon2MemoryKiB || int64(argon2MaxMemoryKiB) > math.MaxUint32 {
+		return nil, fmt.Errorf("Argon2MaxMemoryKiB should be from Argon2MemoryKiB to %d", uint32(math.MaxUint32))
+	}
+	if argon2MemoryKiB < 8*argon2Threads {
+		return nil, fmt.Errorf("Argon2MemoryKiB should be at least 8 * Argon2Threads")
+	}
+	bcryptCost := intOrDefault(appConfig.BcryptCost, defaultBcryptCost)
+	if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("BcryptCost should be from %d to %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	p := Passwords{
+		hashers: map[string]PasswordHasher{
+			PasswordBcrypt: &bcryptHasher{cost: bcryptCost},
+			PasswordArgon2id: &argon2idHasher{
+				argon2idCosts: argon2idCosts{
+					time:      uint32(intOrDefault(appConfig.Argon2Time, defaultArgon2Time)),
+					memoryKiB: uint32(argon2MemoryKiB),
+					threads:   uint8(argon2Threads),
+				},
+				maxMemoryKiB: uint32(argon2MaxMemoryKiB),
+			},
+		},
+		minLength: intOrDefault(appConfig.PasswordMinLength, defaultPasswordMinLength),
+	}
+
+	algorithm := appConfig.PasswordHasher
+	if algorithm == "" {
+		algorithm = PasswordArgon2id
+	}
+	p.current = p.hashers[algorithm]
+	if p.current == nil {
+		return nil, fmt.Errorf("unknown PasswordHasher %q", appConfig.PasswordHasher)
+	}
+
+	var err error
+	if p.dummyHash, err = p.current.Hash("dummy password"); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Same as NewPasswords. Panic on error.
+func MustNewPasswords(appConfig *AppConfig) *Passwords {
+	p, err := NewPasswords(appConfig)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Hash password with current algorithm. Return algorithm and hash to store in UserData.
+func (p *Passwords) Hash(password string) (string, string, error) {
+	hash, err := p.current.Hash(password)
+	return p.current.Algorithm(), hash, err
+}
+
+// Check password of user. User may be nil, then dummy hash is checked and false is returned.
+// Also tell if password should be hashed again with current algorithm and costs.
+func (p *Passwords) Verify(user *UserData, password string) (ok bool, needsRehash bool, err error) {
+	if user == nil {
+		_, err := p.current.Verify(password, p.dummyHash)
+		return false, false, err
+	}
+
+	algorithm := user.PasswordAlgorithm
+	if algorithm == "" {
+		algorithm = PasswordBcrypt
+	}
+	hasher := p.hashers[algorithm]
+	if hasher == nil {
+		return false, false, fmt.Errorf("user %s: unknown password algorithm %q", user.Login, algorithm)
+	}
+	ok, err = hasher.Verify(password, user.PasswordHash)
+	if err != nil || !ok {
+		return false, false, err
+	}
+	return true, hasher != p.current || p.current.NeedsRehash(user.PasswordHash), nil
+}
+
+// No hasher accepts longer passwords, so login can reject them before anything is hashed.
+func (p *Passwords) TooLong(password string) bool {
+	return len(password) > maxPasswordBytes
+}
+
+// Check password for registration. Return message for user or "" if password is fine.
+// Length is checked first, so long passwords are not even normalized.
+func (p *Passwords) ValidatePassword(login, password string) string {
+	if password == "" {
+		return "Password is empty"
+	}
+	if len(password) > p.current.MaxPasswordBytes() {
+		return "Password is too long"
+	}
+	if utf8.RuneCountInString(password) < p.minLength {
+		return fmt.Sprintf("Password should be at least %d characters long", p.minLength)
+	}
+	normalized := NormalizeLogin(password)
+	if normalizedLogin := NormalizeLogin(login); normalizedLogin != "" && strings.Contains(normalized, normalizedLogin) {
+		return "Password should not contain login"
+	}
+	for _, known := range commonPasswords {
+		if normalized == known {
+			return "Password is too common"
+		}
+	}
+	distinct := make(map[rune]bool)
+	for _, r := range password {
+		distinct[r] = true
+	}
+	if len(distinct) < 4 {
+		return "Password should have at least 4 different characters"
+	}
+	return ""
+}
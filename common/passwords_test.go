@@ -0,0 +1,213 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+// Cheap costs, tests do not need strong hashes.
+var testArgon2id = &argon2idHasher{argon2idCosts: argon2idCosts{time: 1, memoryKiB: 64, threads: 1}, maxMemoryKiB: 1024}
+
+func TestArgon2idHashRoundTrip(t *testing.T) {
+	hash, err := testArgon2id.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("hash %q is not in PHC format", hash)
+	}
+
+	parsed, err := parseArgon2idHash(hash, testArgon2id.maxMemoryKiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.argon2idCosts != testArgon2id.argon2idCosts || len(parsed.salt) != argon2SaltLength || len(parsed.key) != argon2KeyLength {
+		t.Errorf("parsed hash is %+v", parsed)
+	}
+
+	for password, want := range map[string]bool{"correct horse": true, "correct horsf": false, "": false} {
+		ok, err := testArgon2id.Verify(password, hash)
+		if err != nil || ok != want {
+			t.Errorf("Verify(%q) is %v, %v, want %v", password, ok, err, want)
+		}
+	}
+
+	other, err := testArgon2id.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == hash {
+		t.Error("hashes of the same password have the same salt")
+	}
+}
+
+func TestParseArgon2idHashErrors(t *testing.T) {
+	const salt = "c2FsdHNhbHRzYWx0c2FsdA"
+	const key = "a2V5a2V5a2V5a2V5"
+	hashes := []string{
+		"",
+		"$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt + "!$" + key,
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt + "$",
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt,
+		"argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key + "$",
+		"$2a$10$abcdefghijklmnopqrstuv",
+		// Costs argon2 can not use or which would take too much memory.
+		"$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=256$" + salt + "$" + key,
+		"$argon2id$v=19$m=15,t=1,p=2$" + salt + "$" + key,
+		"$argon2id$v=19$m=1025,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=4194304,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=-1,t=1,p=1$" + salt + "$" + key,
+	}
+	for _, hash := range hashes {
+		if _, err := parseArgon2idHash(hash, testArgon2id.maxMemoryKiB); err != ErrBadPasswordHash {
+			t.Errorf("parseArgon2idHash(%q): error is %v", hash, err)
+		}
+		if ok, err := testArgon2id.Verify("password", hash); ok || err == nil {
+			t.Errorf("Verify(%q) is %v, %v", hash, ok, err)
+		}
+	}
+	for _, costs := range []string{"m=64,t=1,p=1", "m=16,t=1,p=2", "m=1024,t=1,p=1"} {
+		if _, err := parseArgon2idHash("$argon2id$v=19$"+costs+"$"+salt+"$"+key, testArgon2id.maxMemoryKiB); err != nil {
+			t.Errorf("valid hash with %s: %v", costs, err)
+		}
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	hash, err := testArgon2id.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		hasher argon2idHasher
+		want   bool
+	}{
+		{*testArgon2id, false},
+		{argon2idHasher{argon2idCosts{time: 2, memoryKiB: 64, threads: 1}, 1024}, true},
+		{argon2idHasher{argon2idCosts{time: 1, memoryKiB: 128, threads: 1}, 1024}, true},
+		{argon2idHasher{argon2idCosts{time: 1, memoryKiB: 64, threads: 2}, 1024}, true},
+		// Only costs matter, not the cap.
+		{argon2idHasher{argon2idCosts{time: 1, memoryKiB: 64, threads: 1}, 2048}, false},
+	}
+	for _, c := range cases {
+		if got := c.hasher.NeedsRehash(hash); got != c.want {
+			t.Errorf("%+v: NeedsRehash is %v, want %v", c.hasher, got, c.want)
+		}
+	}
+	if !testArgon2id.NeedsRehash("not a hash") {
+		t.Error("bad hash does not need rehash")
+	}
+	// Key of other length.
+	shortKey := hash[:strings.LastIndex(hash, "$")+1] + "a2V5"
+	if !testArgon2id.NeedsRehash(shortKey) {
+		t.Error("hash with short key does not need rehash")
+	}
+}
+
+func TestPasswordsVerifyRehash(t *testing.T) {
+	appConfig := &AppConfig{
+		PasswordHasher:  PasswordArgon2id,
+		BcryptCost:      bcrypt.MinCost,
+		Argon2Time:      1,
+		Argon2MemoryKiB: 64,
+		Argon2Threads:   1,
+	}
+	p := MustNewPasswords(appConfig)
+
+	bcryptHash, err := (&bcryptHasher{cost: bcrypt.MinCost}).Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldArgon2Hash, err := (&argon2idHasher{argon2idCosts{time: 2, memoryKiB: 64, threads: 1}, 1024}).Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	algorithm, currentHash, err := p.Hash("correct horse")
+	if err != nil || algorithm != PasswordArgon2id {
+		t.Fatalf("Hash is %q, %v", algorithm, err)
+	}
+
+	cases := []struct {
+		name        string
+		user        *UserData
+		password    string
+		ok          bool
+		needsRehash bool
+	}{
+		{"bcrypt without algorithm", &UserData{PasswordHash: bcryptHash}, "correct horse", true, true},
+		{"bcrypt", &UserData{PasswordAlgorithm: PasswordBcrypt, PasswordHash: bcryptHash}, "correct horse", true, true},
+		{"argon2id with old costs", &UserData{PasswordAlgorithm: PasswordArgon2id, PasswordHash: oldArgon2Hash}, "correct horse", true, true},
+		{"current", &UserData{PasswordAlgorithm: algorithm, PasswordHash: currentHash}, "correct horse", true, false},
+		{"wrong password", &UserData{PasswordAlgorithm: algorithm, PasswordHash: currentHash}, "wrong horse", false, false},
+		{"wrong bcrypt password", &UserData{PasswordHash: bcryptHash}, "wrong horse", false, false},
+		{"no user", nil, "correct horse", false, false},
+	}
+	for _, c := range cases {
+		ok, needsRehash, err := p.Verify(c.user, c.password)
+		if err != nil || ok != c.ok || needsRehash != c.needsRehash {
+			t.Errorf("%s: Verify is %v, %v, %v, want %v, %v", c.name, ok, needsRehash, err, c.ok, c.needsRehash)
+		}
+	}
+}
+
+func TestNewPasswordsArgon2MaxMemory(t *testing.T) {
+	cases := []struct {
+		memoryKiB, maxMemoryKiB, threads int
+		ok                               bool
+	}{
+		{64, 64, 1, true},
+		{64, 0, 1, true},
+		{64, 32, 1, false},
+		{16, 64, 4, false},
+	}
+	for _, c := range cases {
+		_, err := NewPasswords(&AppConfig{
+			PasswordHasher:     PasswordArgon2id,
+			Argon2Time:         1,
+			Argon2MemoryKiB:    c.memoryKiB,
+			Argon2MaxMemoryKiB: c.maxMemoryKiB,
+			Argon2Threads:      c.threads,
+		})
+		if (err == nil) != c.ok {
+			t.Errorf("%+v: error is %v", c, err)
+		}
+	}
+}
+
+func TestValidatePasswordLength(t *testing.T) {
+	p := MustNewPasswords(&AppConfig{PasswordHasher: PasswordBcrypt, BcryptCost: bcrypt.MinCost})
+	long := strings.Repeat("abcd", 19)
+	if message := p.ValidatePassword("user", long); message != "Password is too long" {
+		t.Errorf("76 bytes password for bcrypt: %q", message)
+	}
+	if message := p.ValidatePassword("user", long[:72]); message != "" {
+		t.Errorf("72 bytes password for bcrypt: %q", message)
+	}
+	if p.TooLong(strings.Repeat("a", maxPasswordBytes)) || !p.TooLong(strings.Repeat("a", maxPasswordBytes+1)) {
+		t.Error("TooLong does not match maxPasswordBytes")
+	}
+}
@@ -0,0 +1,469 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Accepted pixel placement. Stored in redis stream "Placements:<canvas>:<shard>".
+type PlacementEvent struct {
+	// Stream entry id. Assigned by redis, monotonically increasing within shard.
+	Id string
+	// Canvas name (see CanvasConfig).
+	Canvas string
+	Login  string
+	X      int
+	Y      int
+	Color  uint8
+	// Number of ws_server instance which accepted placement.
+	Shard int
+	// Unix time in milliseconds.
+	Time int64
+}
+
+// Number of stream entries fetched by one XRANGE call.
+const placementsBatchSize = 1000
+
+func placementsStreamKey(canvas string, shard int) string {
+	return "Placements:" + canvas + ":" + strconv.Itoa(shard)
+}
+
+// Placement lost shard lease (see ShardLease).
+var ErrShardLeaseLost = errors.New("shard lease lost")
+
+const lostShardLeaseError = "LOST_SHARD_LEASE"
+
+var appendPlacementScript = redis.NewScript(fencePrelude + `
+if redis.call("GET", KEYS[4]) ~= ARGV[10] then
+	return redis.error_reply("` + lostShardLeaseError + `")
+end
+local id = redis.call(
+	"XADD", KEYS[2], "*",
+	"login", ARGV[2], "x", ARGV[3], "y", ARGV[4], "color", ARGV[5], "shard", ARGV[6], "time", ARGV[7]
+)
+redis.call("HSET", KEYS[3], ARGV[8], ARGV[9])
+return id
+`)
+
+// Append placement to log and update attribution of placed pixel. Return id assigned to event.
+// Placement is rejected with ErrShardMapChanged if shard map has changed since mapVersion
+// and with ErrShardLeaseLost if lease of event.Shard is not held by lease holder anymore.
+func AppendPlacement(rdb *redis.Client, event *PlacementEvent, mapVersion int64, lease *ShardLease) (string, error) {
+	attribution, err := json.Marshal(&PixelAttribution{
+		Login: event.Login,
+		Time:  event.Time,
+	})
+	if err != nil {
+		return "", err
+	}
+	leaseValue, err := lease.value()
+	if err != nil {
+		return "", err
+	}
+
+	id, err := appendPlacementScript.Run(
+		rdb,
+		[]string{
+			shardMapKey(event.Canvas),
+			placementsStreamKey(event.Canvas, event.Shard),
+			pixelAttributionKey(event.Canvas),
+			shardLeaseKey(event.Shard),
+		},
+		mapVersion,
+		event.Login,
+		event.X,
+		event.Y,
+		event.Color,
+		event.Shard,
+		event.Time,
+		pixelAttributionField(event.X, event.Y),
+		attribution,
+		leaseValue,
+	).String()
+	if err != nil && strings.HasPrefix(err.Error(), lostShardLeaseError) {
+		return "", ErrShardLeaseLost
+	}
+	return id, fenceError(err)
+}
+
+// Id of the oldest placement in log of canvas shard. Empty if log is empty.
+func FirstPlacementId(rdb *redis.Client, canvas string, shard int) (string, error) {
+	messages, err := rdb.XRangeN(placementsStreamKey(canvas, shard), "-", "+", 1).Result()
+	if err != nil || len(messages) == 0 {
+		return "", err
+	}
+	return messages[0].ID, nil
+}
+
+func placementsTrimmedKey(canvas string) string {
+	return "PlacementsTrimmed:" + canvas
+}
+
+// Remove placements logged before placement with given id (it is kept, so log is never empty
+// once anything was logged). Canvas is marked as trimmed first (see PlacementLogTrimmed).
+// Needs redis 6.2 or newer.
+func TrimPlacements(rdb *redis.Client, canvas string, shard int, beforeId string) error {
+	if beforeId == "" {
+		return nil
+	}
+	if err := rdb.Set(placementsTrimmedKey(canvas), 1, 0).Err(); err != nil {
+		return err
+	}
+	return rdb.Do("XTRIM", placementsStreamKey(canvas, shard), "MINID", beforeId).Err()
+}
+
+// Was any placement of canvas ever removed from log. History can not be replayed from
+// initial image then.
+func PlacementLogTrimmed(rdb *redis.Client, canvas string) (bool, error) {
+	count, err := rdb.Exists(placementsTrimmedKey(canvas)).Result()
+	return count > 0, err
+}
+
+// Is placement id `a' older than `b'. Empty id is older than any other.
+func PlacementIdLess(a, b string) bool {
+	parse := func(id string) (int64, int64) {
+		parts := strings.SplitN(id, "-", 2)
+		ms, _ := strconv.ParseInt(parts[0], 10, 64)
+		var seq int64
+		if len(parts) == 2 {
+			seq, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+		return ms, seq
+	}
+	if a == "" || b == "" {
+		return a == "" && b != ""
+	}
+	msA, seqA := parse(a)
+	msB, seqB := parse(b)
+	return msA < msB || (msA == msB && seqA < seqB)
+}
+
+// Wait up to `block' for placements of shard logged after given ids and return them in order of each log.
+// `afterIds' maps canvas name to id of last known placement (empty means from the very beginning).
+// Return nothing if there are no new placements.
+func ReadNewPlacements(
+	rdb *redis.Client,
+	shard int,
+	afterIds map[string]string,
+	block time.Duration,
+) ([]PlacementEvent, error) {
+	keys := make([]string, 0, len(afterIds))
+	ids := make([]string, 0, len(afterIds))
+	canvases := make(map[string]string)
+	for canvas, afterId := range afterIds {
+		key := placementsStreamKey(canvas, shard)
+		if afterId == "" {
+			afterId = "0"
+		}
+		keys = append(keys, key)
+		ids = append(ids, afterId)
+		canvases[key] = canvas
+	}
+
+	streams, err := rdb.XRead(&redis.XReadArgs{
+		Streams: append(keys, ids...),
+		Count:   placementsBatchSize,
+		Block:   block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]PlacementEvent, 0)
+	for _, stream := range streams {
+		for i := range stream.Messages {
+			event, err := placementFromStreamMessage(canvases[stream.Stream], &stream.Messages[i])
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, *event)
+		}
+	}
+	return events, nil
+}
+
+// Who placed pixel and when. Stored in redis hash "PixelAttribution:<canvas>" (field is "x:y").
+type PixelAttribution struct {
+	Login string
+	// Unix time in milliseconds.
+	Time int64
+}
+
+func pixelAttributionKey(canvas string) string {
+	return "PixelAttribution:" + canvas
+}
+
+func pixelAttributionField(x, y int) string {
+	return strconv.Itoa(x) + ":" + strconv.Itoa(y)
+}
+
+// Get last placement info for pixel. Return nil if nobody has placed this pixel yet.
+func GetPixelAttribution(rdb *redis.Client, canvas string, x, y int) (*PixelAttribution, error) {
+	rawVal, err := rdb.HGet(pixelAttributionKey(canvas), pixelAttributionField(x, y)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rec PixelAttribution
+	if err := json.Unmarshal([]byte(rawVal), &rec); err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+// Call fn for each placement of canvas shard logged after event with id `afterId' (in order).
+// Empty `afterId' means from the very beginning.
+func ForEachPlacement(
+	rdb *redis.Client,
+	canvas string,
+	shard int,
+	afterId string,
+	fn func(event *PlacementEvent) error,
+) error {
+	start := afterId
+	if start == "" {
+		start = "-"
+	}
+
+	for {
+		messages, err := rdb.XRangeN(placementsStreamKey(canvas, shard), start, "+", placementsBatchSize).Result()
+		if err != nil {
+			return err
+		}
+
+		processed := 0
+		for _, message := range messages {
+			// XRANGE start is inclusive.
+			if message.ID == start {
+				continue
+			}
+			event, err := placementFromStreamMessage(canvas, &message)
+			if err != nil {
+				return err
+			}
+			if err := fn(event); err != nil {
+				return err
+			}
+			start = message.ID
+			processed++
+		}
+
+		if processed == 0 {
+			return nil
+		}
+	}
+}
+
+func placementFromStreamMessage(canvas string, message *redis.XMessage) (*PlacementEvent, error) {
+	getInt := func(key string) (int64, error) {
+		raw, ok := message.Values[key].(string)
+		if !ok {
+			return 0, fmt.Errorf("placement %s: expected '%s' field", message.ID, key)
+		}
+		return strconv.ParseInt(raw, 10, 64)
+	}
+
+	event := PlacementEvent{Id: message.ID, Canvas: canvas}
+	event.Login, _ = message.Values["login"].(string)
+
+	x, err := getInt("x")
+	if err != nil {
+		return nil, err
+	}
+	y, err := getInt("y")
+	if err != nil {
+		return nil, err
+	}
+	color, err := getInt("color")
+	if err != nil {
+		return nil, err
+	}
+	shard, err := getInt("shard")
+	if err != nil {
+		return nil, err
+	}
+	eventTime, err := getInt("time")
+	if err != nil {
+		return nil, err
+	}
+
+	event.X = int(x)
+	event.Y = int(y)
+	event.Color = uint8(color)
+	event.Shard = int(shard)
+	event.Time = eventTime
+
+	return &event, nil
+}
+
+// Time of the first placement on canvas (unix ms). Return false if nothing was placed yet.
+func FirstPlacementTime(rdb *redis.Client, canvas string, totalShards int) (int64, bool, error) {
+	var first int64
+	found := false
+	for shard := 0; shard < totalShards; shard++ {
+		messages, err := rdb.XRangeN(placementsStreamKey(canvas, shard), "-", "+", 1).Result()
+		if err != nil {
+			return 0, false, err
+		}
+		if len(messages) == 0 {
+			continue
+		}
+		event, err := placementFromStreamMessage(canvas, &messages[0])
+		if err != nil {
+			return 0, false, err
+		}
+		if !found || event.Time < first {
+			first = event.Time
+			found = true
+		}
+	}
+	return first, found, nil
+}
+
+// Reads placement log of one shard batch by batch.
+type placementCursor struct {
+	rdb    *redis.Client
+	canvas string
+	shard  int
+	start  string
+	events []PlacementEvent
+	done   bool
+}
+
+// Current placement or nil if log is over. Fetches next batch when needed.
+func (c *placementCursor) head() (*PlacementEvent, error) {
+	if len(c.events) == 0 && !c.done {
+		messages, err := c.rdb.XRangeN(placementsStreamKey(c.canvas, c.shard), c.start, "+", placementsBatchSize).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i := range messages {
+			// XRANGE start is inclusive.
+			if messages[i].ID == c.start {
+				continue
+			}
+			event, err := placementFromStreamMessage(c.canvas, &messages[i])
+			if err != nil {
+				return nil, err
+			}
+			c.events = append(c.events, *event)
+			c.start = messages[i].ID
+		}
+		c.done = len(c.events) == 0
+	}
+	if len(c.events) == 0 {
+		return nil, nil
+	}
+	return &c.events[0], nil
+}
+
+// Call fn for placements of canvas from all shards made till `until' (unix ms), ordered by time.
+// Logs are read in batches, so whole history is never kept in memory.
+func ForEachPlacementUntil(
+	rdb *redis.Client,
+	canvas string,
+	totalShards int,
+	until int64,
+	fn func(event *PlacementEvent) error,
+) error {
+	cursors := make([]*placementCursor, totalShards)
+	for shard := range cursors {
+		cursors[shard] = &placementCursor{rdb: rdb, canvas: canvas, shard: shard, start: "-"}
+	}
+
+	for {
+		// Oldest head of all logs. On same time lower shard goes first.
+		var next *placementCursor
+		var nextEvent *PlacementEvent
+		for _, cursor := range cursors {
+			event, err := cursor.head()
+			if err != nil {
+				return err
+			}
+			if event != nil && event.Time <= until && (nextEvent == nil || event.Time < nextEvent.Time) {
+				next = cursor
+				nextEvent = event
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		if err := fn(nextEvent); err != nil {
+			return err
+		}
+		next.events = next.events[1:]
+	}
+}
+
+// Accepted placement as announced to all ws_server instances through redis channel "PlacementsLive:<canvas>".
+// Version is matrix version of Shard after placement.
+type LivePlacement struct {
+	// Random id of publishing process. Instances skip their own placements by it.
+	Publisher string
+	Canvas    string
+	Shard     int
+	X         int
+	Y         int
+	Color     uint8
+	Version   uint64
+}
+
+func livePlacementsChannel(canvas string) string {
+	return "PlacementsLive:" + canvas
+}
+
+// Announce accepted placement to all instances.
+func PublishPlacement(rdb *redis.Client, placement *LivePlacement) error {
+	payload, err := json.Marshal(placement)
+	if err != nil {
+		return err
+	}
+	return rdb.Publish(livePlacementsChannel(placement.Canvas), payload).Err()
+}
+
+// Subscribe to placements announced for given canvases. Read them with ParseLivePlacement.
+func SubscribePlacements(rdb *redis.Client, canvases []string) *redis.PubSub {
+	channels := make([]string, len(canvases))
+	for i, canvas := range canvases {
+		channels[i] = livePlacementsChannel(canvas)
+	}
+	return rdb.Subscribe(channels...)
+}
+
+func ParseLivePlacement(msg *redis.Message) (*LivePlacement, error) {
+	placement := LivePlacement{}
+	if err := json.Unmarshal([]byte(msg.Payload), &placement); err != nil {
+		return nil, err
+	}
+	return &placement, nil
+}
@@ -0,0 +1,119 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"encoding/json"
+	"github.com/go-redis/redis"
+	"reflect"
+	"testing"
+)
+
+func TestPlacementIdLess(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"", "", false},
+		{"", "1-0", true},
+		{"1-0", "", false},
+		{"1-0", "1-0", false},
+		{"1-0", "1-1", true},
+		{"1-1", "1-0", false},
+		{"9-5", "10-0", true},
+		{"10-0", "9-5", false},
+		{"1526919030474-55", "1526919030474-100", true},
+		// Ids without sequence number (XADD with explicit id).
+		{"5", "5-1", true},
+		{"6", "5-1", false},
+	}
+	for _, c := range cases {
+		if got := PlacementIdLess(c.a, c.b); got != c.want {
+			t.Errorf("PlacementIdLess(%q, %q) is %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestPlacementFromStreamMessage(t *testing.T) {
+	values := map[string]interface{}{
+		"login": "user",
+		"x":     "12",
+		"y":     "34",
+		"color": "5",
+		"shard": "1",
+		"time":  "1500000000123",
+	}
+	event, err := placementFromStreamMessage("main", &redis.XMessage{ID: "1500000000123-0", Values: values})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PlacementEvent{
+		Id:     "1500000000123-0",
+		Canvas: "main",
+		Login:  "user",
+		X:      12,
+		Y:      34,
+		Color:  5,
+		Shard:  1,
+		Time:   1500000000123,
+	}
+	if !reflect.DeepEqual(*event, want) {
+		t.Errorf("event is %+v, want %+v", *event, want)
+	}
+
+	for _, field := range []string{"x", "y", "color", "shard", "time"} {
+		broken := make(map[string]interface{})
+		for key, value := range values {
+			broken[key] = value
+		}
+		delete(broken, field)
+		if _, err := placementFromStreamMessage("main", &redis.XMessage{ID: "1-0", Values: broken}); err == nil {
+			t.Errorf("message without %s is parsed", field)
+		}
+		broken[field] = "not a number"
+		if _, err := placementFromStreamMessage("main", &redis.XMessage{ID: "1-0", Values: broken}); err == nil {
+			t.Errorf("message with bad %s is parsed", field)
+		}
+	}
+}
+
+func TestPixelAttributionEncoding(t *testing.T) {
+	// Every pixel has its own hash field.
+	fields := make(map[string]bool)
+	for _, p := range [][2]int{{1, 23}, {12, 3}, {123, 0}, {0, 123}, {0, 0}} {
+		field := pixelAttributionField(p[0], p[1])
+		if fields[field] {
+			t.Errorf("field %q is used by several pixels", field)
+		}
+		fields[field] = true
+	}
+
+	// Stored value is read back as is.
+	raw, err := json.Marshal(&PixelAttribution{Login: "Ünicode_user", Time: 1500000000123})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attribution PixelAttribution
+	if err := json.Unmarshal(raw, &attribution); err != nil {
+		t.Fatal(err)
+	}
+	if attribution.Login != "Ünicode_user" || attribution.Time != 1500000000123 {
+		t.Errorf("attribution is %+v after JSON", attribution)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Current assignment of canvas chunks to shards. Stored in redis hash "ShardMap:<canvas>".
+// Created from config on first use and changed only by Reshard.
+type ShardMap struct {
+	// Incremented on every resharding.
+	Version int64
+	Layout  *CanvasLayout
+	// Greatest number of shards canvas has ever had. Placement logs of all of them make canvas history.
+	MaxShards int
+	// Resharding is in progress. Placements and checkpoints are rejected until it is finished.
+	Frozen bool
+}
+
+// Redis channel with names of resharded canvases.
+const ShardMapUpdatesChannel = "ShardMapUpdates"
+
+// Placement or checkpoint was made for outdated shard map or during resharding.
+var ErrShardMapChanged = errors.New("shard map has changed")
+
+// Error returned by fenced scripts, see fencePrelude.
+const staleShardMapError = "STALE_SHARD_MAP"
+
+// Lua code which aborts script if shard map KEYS[1] is frozen or its version is not ARGV[1].
+const fencePrelude = `
+if redis.call("HGET", KEYS[1], "frozen") == "1" or redis.call("HGET", KEYS[1], "version") ~= ARGV[1] then
+	return redis.error_reply("` + staleShardMapError + `")
+end
+`
+
+// Convert fenced script error to ErrShardMapChanged.
+func fenceError(err error) error {
+	if err != nil && strings.HasPrefix(err.Error(), staleShardMapError) {
+		return ErrShardMapChanged
+	}
+	return err
+}
+
+var initShardMapScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("HMSET", KEYS[1], "version", ARGV[1], "layout", ARGV[2], "maxShards", ARGV[3], "frozen", "0")
+end
+return 1
+`)
+
+func shardMapKey(canvas string) string {
+	return "ShardMap:" + canvas
+}
+
+// Get shard map of canvas. Create it from config if canvas has none yet.
+func GetShardMap(rdb *redis.Client, canvasConfig *CanvasConfig, shardCount int) (*ShardMap, error) {
+	key := shardMapKey(canvasConfig.Name)
+	values, err := rdb.HGetAll(key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		layout, err := NewCanvasLayout(canvasConfig, shardCount)
+		if err != nil {
+			return nil, err
+		}
+		rawLayout, err := json.Marshal(layout)
+		if err != nil {
+			return nil, err
+		}
+		if err := initShardMapScript.Run(rdb, []string{key}, 1, rawLayout, shardCount).Err(); err != nil {
+			return nil, err
+		}
+		if values, err = rdb.HGetAll(key).Result(); err != nil {
+			return nil, err
+		}
+	}
+
+	shardMap := ShardMap{Layout: &CanvasLayout{}, Frozen: values["frozen"] == "1"}
+	if shardMap.Version, err = strconv.ParseInt(values["version"], 10, 64); err != nil {
+		return nil, fmt.Errorf("canvas %s: bad shard map version: %v", canvasConfig.Name, err)
+	}
+	if shardMap.MaxShards, err = strconv.Atoi(values["maxShards"]); err != nil {
+		return nil, fmt.Errorf("canvas %s: bad shard map max shards: %v", canvasConfig.Name, err)
+	}
+	if err := json.Unmarshal([]byte(values["layout"]), shardMap.Layout); err != nil {
+		return nil, fmt.Errorf("canvas %s: bad shard map layout: %v", canvasConfig.Name, err)
+	}
+	return &shardMap, nil
+}
+
+// Id of last entry of placement log. Empty string if log is empty.
+func lastPlacementId(rdb *redis.Client, canvas string, shard int) (string, error) {
+	messages, err := rdb.XRevRangeN(placementsStreamKey(canvas, shard), "+", "-", 1).Result()
+	if err != nil || len(messages) == 0 {
+		return "", err
+	}
+	return messages[0].ID, nil
+}
+
+// Move canvas to layout built from config for shardCount shards:
+//  1. Freeze shard map. Instances stop accepting placements, so logs and checkpoints stop changing.
+//  2. Assemble canvas from checkpoints and logs of old layout.
+//  3. Atomically write checkpoints of new layout and new shard map. This is the cutover point.
+//  4. Notify instances (see ShardMapUpdatesChannel). They load new checkpoints and tell clients.
+//     Instances of shards above shardCount exit.
+//
+// If it fails before cutover, map is unfrozen, so canvas keeps working with old layout until it is rerun.
+// Return new shard map (or current one if layout is the same).
+func Reshard(rdb *redis.Client, canvasConfig *CanvasConfig, shardCount int) (*ShardMap, error) {
+	current, err := GetShardMap(rdb, canvasConfig, shardCount)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := NewCanvasLayout(canvasConfig, shardCount)
+	if err != nil {
+		return nil, err
+	}
+	if !current.Frozen && current.Layout.Equal(layout) {
+		return current, nil
+	}
+
+	// Random id of this resharding, so it does not unfreeze map frozen by other one.
+	rawFreezeId := make([]byte, 16)
+	if _, err := rand.Read(rawFreezeId); err != nil {
+		return nil, err
+	}
+	freezeId := hex.EncodeToString(rawFreezeId)
+
+	key := shardMapKey(canvasConfig.Name)
+	if err := rdb.HMSet(key, map[string]interface{}{"frozen": "1", "frozenBy": freezeId}).Err(); err != nil {
+		return nil, err
+	}
+
+	next, err := cutOver(rdb, canvasConfig, current, layout, shardCount)
+	if err != nil {
+		if unfreezeErr := unfreezeShardMapScript.Run(rdb, []string{key}, current.Version, freezeId).Err(); unfreezeErr != nil {
+			return nil, fmt.Errorf("%v (shard map stays frozen: %v)", err, unfreezeErr)
+		}
+		return nil, err
+	}
+
+	if err := rdb.Publish(ShardMapUpdatesChannel, canvasConfig.Name).Err(); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// Undo freeze of shard map KEYS[1] made by resharding ARGV[2] unless map was changed since version ARGV[1].
+var unfreezeShardMapScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "version") == ARGV[1] and redis.call("HGET", KEYS[1], "frozenBy") == ARGV[2] then
+	redis.call("HSET", KEYS[1], "frozen", "0")
+	redis.call("HDEL", KEYS[1], "frozenBy")
+end
+return 1
+`)
+
+// Steps 2 and 3 of Reshard: assemble canvas of frozen map `current' and write it with new layout.
+func cutOver(
+	rdb *redis.Client,
+	canvasConfig *CanvasConfig,
+	current *ShardMap,
+	layout *CanvasLayout,
+	shardCount int,
+) (*ShardMap, error) {
+	key := shardMapKey(canvasConfig.Name)
+	canvas, err := AssembleCanvas(rdb, canvasConfig, current.Layout)
+	if err != nil {
+		return nil, err
+	}
+
+	next := ShardMap{
+		Version:   current.Version + 1,
+		Layout:    layout,
+		MaxShards: current.MaxShards,
+	}
+	if shardCount > next.MaxShards {
+		next.MaxShards = shardCount
+	}
+
+	snapshots := make([]CanvasSnapshot, shardCount)
+	for shard := range snapshots {
+		colorCodes := instanceColorCodes(canvas, layout, shard)
+		// New owner skips placements logged with old layout, they are in checkpoint already.
+		lastId, err := lastPlacementId(rdb, canvasConfig.Name, shard)
+		if err != nil {
+			return nil, err
+		}
+		snapshots[shard] = CanvasSnapshot{
+			Canvas:          canvasConfig.Name,
+			ColorCodes:      colorCodes,
+			Layout:          *layout,
+			InstanceNumber:  shard,
+			MapVersion:      next.Version,
+			LastPlacementId: lastId,
+			CreatedAt:       time.Now().Unix(),
+		}
+	}
+
+	rawLayout, err := json.Marshal(layout)
+	if err != nil {
+		return nil, err
+	}
+	err = rdb.Watch(func(tx *redis.Tx) error {
+		version, err := tx.HGet(key, "version").Result()
+		if err != nil {
+			return err
+		}
+		if version != strconv.FormatInt(current.Version, 10) {
+			return errors.New("concurrent resharding")
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			for shard := range snapshots {
+				rawSnapshot, err := json.Marshal(&snapshots[shard])
+				if err != nil {
+					return err
+				}
+				pipe.Set(snapshotKey(canvasConfig.Name, shard), rawSnapshot, 0)
+			}
+			for shard := shardCount; shard < next.MaxShards; shard++ {
+				pipe.Del(snapshotKey(canvasConfig.Name, shard))
+			}
+			pipe.HMSet(key, map[string]interface{}{
+				"version":   next.Version,
+				"layout":    rawLayout,
+				"maxShards": next.MaxShards,
+				"frozen":    "0",
+			})
+			pipe.HDel(key, "frozenBy")
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// Cut data of instance from whole canvas (color codes row by row) laid out with layout.
+func instanceColorCodes(canvas []byte, layout *CanvasLayout, instance int) []byte {
+	instanceLayout := layout.ForInstance(instance)
+	colorCodes := make([]byte, instanceLayout.DataSize())
+	for y := 0; y < layout.Height; y++ {
+		for x := 0; x < layout.Width; x++ {
+			if i := instanceLayout.Index(x, y); i >= 0 {
+				colorCodes[i] = canvas[y*layout.Width+x]
+			}
+		}
+	}
+	return colorCodes
+}
@@ -0,0 +1,75 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"testing"
+)
+
+func TestInstanceColorCodes(t *testing.T) {
+	// Canvas is not a multiple of chunk size, so edge chunks are clipped.
+	l := MustNewCanvasLayout(&CanvasConfig{
+		CanvasCols:  11,
+		CanvasRows:  6,
+		ChunkSize:   4,
+		ChunkOwners: map[string]int{"2:1": 0},
+	}, 3)
+	canvas := make([]byte, l.Width*l.Height)
+	for i := range canvas {
+		canvas[i] = byte(i)
+	}
+
+	// Every pixel goes to exactly one instance, at its Index.
+	owners := make([]int, len(canvas))
+	for i := range owners {
+		owners[i] = -1
+	}
+	for instance := 0; instance < l.Shards; instance++ {
+		il := l.ForInstance(instance)
+		colorCodes := instanceColorCodes(canvas, l, instance)
+		if len(colorCodes) != il.DataSize() {
+			t.Fatalf("instance %d: %d color codes, want %d", instance, len(colorCodes), il.DataSize())
+		}
+		for y := 0; y < l.Height; y++ {
+			for x := 0; x < l.Width; x++ {
+				i := il.Index(x, y)
+				if i < 0 {
+					continue
+				}
+				if owners[y*l.Width+x] >= 0 {
+					t.Errorf("(%d, %d) belongs to instances %d and %d", x, y, owners[y*l.Width+x], instance)
+				}
+				owners[y*l.Width+x] = instance
+				if colorCodes[i] != canvas[y*l.Width+x] {
+					t.Errorf("instance %d: (%d, %d) is %d, want %d", instance, x, y, colorCodes[i], canvas[y*l.Width+x])
+				}
+			}
+		}
+	}
+	for i, owner := range owners {
+		if owner < 0 {
+			t.Errorf("(%d, %d) belongs to no instance", i%l.Width, i/l.Width)
+		}
+	}
+
+	// Instance without chunks gets no data.
+	if colorCodes := instanceColorCodes(canvas, l, l.Shards); len(colorCodes) != 0 {
+		t.Errorf("instance out of layout has %d color codes", len(colorCodes))
+	}
+}
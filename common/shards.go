@@ -0,0 +1,236 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis"
+	"strconv"
+	"time"
+)
+
+// Lease of shard number by ws_server instance (primary). Stored in redis key "ShardLease:<shard>" with TTL,
+// instance has to renew it until it stops serving shard. Instances which did not get free shard become
+// replicas: they follow primary's placement log and take lease over when it expires.
+type ShardLease struct {
+	Shard   int
+	Address string
+	// Random id of lease holder. Lease is renewed and released only by its holder.
+	Holder string
+}
+
+// Default lease TTL if AppConfig.ShardLeaseSeconds is not set.
+const defaultShardLeaseSeconds = 10
+
+// All shards are held by other instances.
+var ErrNoFreeShards = errors.New("no free shards")
+
+// Renew lease only if it is still held by the same holder.
+var renewShardLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// Delete lease only if it is still held by the same holder.
+var releaseShardLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func shardLeaseKey(shard int) string {
+	return "ShardLease:" + strconv.Itoa(shard)
+}
+
+// Sorted set of replicas of shard. Score is expiry time of replica registration.
+func shardReplicasKey(shard int) string {
+	return "ShardReplicas:" + strconv.Itoa(shard)
+}
+
+// Lease TTL from config.
+func ShardLeaseTTL(appConfig *AppConfig) time.Duration {
+	seconds := appConfig.ShardLeaseSeconds
+	if seconds <= 0 {
+		seconds = defaultShardLeaseSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Make lease with random holder id. It is not claimed until Acquire.
+func NewShardLease(shard int, address string) (*ShardLease, error) {
+	holder := make([]byte, 16)
+	if _, err := rand.Read(holder); err != nil {
+		return nil, err
+	}
+	return &ShardLease{
+		Shard:   shard,
+		Address: address,
+		Holder:  hex.EncodeToString(holder),
+	}, nil
+}
+
+// Claim shard if it is free. Return false if it is held by other instance.
+func (l *ShardLease) Acquire(rdb *redis.Client, ttl time.Duration) (bool, error) {
+	value, err := l.value()
+	if err != nil {
+		return false, err
+	}
+	return rdb.SetNX(shardLeaseKey(l.Shard), value, ttl).Result()
+}
+
+// Claim free shard number for instance reachable at address.
+// Try only preferredShard if it is not negative, otherwise take first free shard.
+// Return ErrNoFreeShards if all of them are held.
+func AcquireShardLease(
+	rdb *redis.Client,
+	shardCount int,
+	preferredShard int,
+	address string,
+	ttl time.Duration,
+) (*ShardLease, error) {
+	shards := make([]int, 0, shardCount)
+	if preferredShard >= 0 {
+		shards = append(shards, preferredShard)
+	} else {
+		for shard := 0; shard < shardCount; shard++ {
+			shards = append(shards, shard)
+		}
+	}
+
+	for _, shard := range shards {
+		lease, err := NewShardLease(shard, address)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := lease.Acquire(rdb, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return lease, nil
+		}
+	}
+
+	return nil, ErrNoFreeShards
+}
+
+// Register lease holder as replica of the shard for ttl. Call it again to extend registration.
+func (l *ShardLease) RegisterReplica(rdb *redis.Client, ttl time.Duration) error {
+	expiry := float64(time.Now().Add(ttl).Unix())
+	return rdb.ZAdd(shardReplicasKey(l.Shard), redis.Z{Score: expiry, Member: l.Holder}).Err()
+}
+
+func (l *ShardLease) UnregisterReplica(rdb *redis.Client) error {
+	return rdb.ZRem(shardReplicasKey(l.Shard), l.Holder).Err()
+}
+
+// Shard with the least number of live replicas.
+func LeastReplicatedShard(rdb *redis.Client, shardCount int) (int, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	best, bestReplicas := 0, int64(-1)
+	for shard := 0; shard < shardCount; shard++ {
+		key := shardReplicasKey(shard)
+		if err := rdb.ZRemRangeByScore(key, "-inf", now).Err(); err != nil {
+			return 0, err
+		}
+		replicas, err := rdb.ZCard(key).Result()
+		if err != nil {
+			return 0, err
+		}
+		if bestReplicas < 0 || replicas < bestReplicas {
+			best, bestReplicas = shard, replicas
+		}
+	}
+	return best, nil
+}
+
+func (l *ShardLease) value() (string, error) {
+	value, err := json.Marshal(l)
+	return string(value), err
+}
+
+// Extend lease. Return false if lease has expired and is lost.
+func (l *ShardLease) Renew(rdb *redis.Client, ttl time.Duration) (bool, error) {
+	value, err := l.value()
+	if err != nil {
+		return false, err
+	}
+	renewed, err := renewShardLeaseScript.Run(
+		rdb, []string{shardLeaseKey(l.Shard)}, value, int64(ttl/time.Millisecond),
+	).Int()
+	return renewed == 1, err
+}
+
+// Give shard away, so other instance may take it without waiting for expiry.
+func (l *ShardLease) Release(rdb *redis.Client) error {
+	value, err := l.value()
+	if err != nil {
+		return err
+	}
+	return releaseShardLeaseScript.Run(rdb, []string{shardLeaseKey(l.Shard)}, value).Err()
+}
+
+// Address of instance holding shard. Empty string if shard is not claimed.
+func GetShardAddress(rdb *redis.Client, shard int) (string, error) {
+	raw, err := rdb.Get(shardLeaseKey(shard)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	lease := ShardLease{}
+	if err := json.Unmarshal([]byte(raw), &lease); err != nil {
+		return "", err
+	}
+	return lease.Address, nil
+}
+
+// Addresses of instances holding shards 0..shardCount-1. Empty string if shard is not claimed.
+func GetShardAddresses(rdb *redis.Client, shardCount int) ([]string, error) {
+	keys := make([]string, shardCount)
+	for shard := range keys {
+		keys[shard] = shardLeaseKey(shard)
+	}
+
+	values, err := rdb.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, shardCount)
+	for shard, value := range values {
+		raw, ok := value.(string)
+		if !ok {
+			continue
+		}
+		lease := ShardLease{}
+		if err := json.Unmarshal([]byte(raw), &lease); err != nil {
+			return nil, err
+		}
+		addresses[shard] = lease.Address
+	}
+	return addresses, nil
+}
@@ -0,0 +1,120 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Default lifetime of websocket ticket.
+const defaultWebSocketTicketSeconds = 60
+
+var ErrBadTicket = errors.New("bad or expired websocket ticket")
+
+// Ticket is sent in Sec-WebSocket-Protocol header, not in URL, so it does not end up in access logs
+// and browser history. Client offers WebSocketSubprotocol and "ticket.<ticket>" (ticket is made of
+// base64url and '.', which are allowed in header tokens), server selects WebSocketSubprotocol.
+const (
+	WebSocketSubprotocol    = "shittypixels"
+	ticketSubprotocolPrefix = "ticket."
+)
+
+// Subprotocols which websocket client offers to authenticate with ticket.
+func TicketSubprotocols(ticket string) []string {
+	return []string{WebSocketSubprotocol, ticketSubprotocolPrefix + ticket}
+}
+
+// Ticket from subprotocols offered by client. Empty string if there is none.
+func TicketFromSubprotocols(subprotocols []string) string {
+	for _, protocol := range subprotocols {
+		if strings.HasPrefix(protocol, ticketSubprotocolPrefix) {
+			return strings.TrimPrefix(protocol, ticketSubprotocolPrefix)
+		}
+	}
+	return ""
+}
+
+// User of websocket connection. Resolved once when connection is opened.
+type WebSocketIdentity struct {
+	Login string
+	// Identifies session without revealing its id (see SessionKey).
+	SessionKey string
+	// Unix time ticket expires at (only for identities from tickets).
+	Expiry int64 `json:",omitempty"`
+}
+
+// Session identifier which is safe to pass around: session id can not be restored from it.
+func SessionKey(sessionId string) string {
+	sum := sha256.Sum256([]byte(sessionId))
+	return hex.EncodeToString(sum[:])
+}
+
+func WebSocketTicketTTL(appConfig *AppConfig) time.Duration {
+	seconds := appConfig.WebSocketTicketSeconds
+	if seconds <= 0 {
+		seconds = defaultWebSocketTicketSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func signTicket(appConfig *AppConfig, payload string) string {
+	return hmacSign(appConfig.WebSocketTicketSecret, payload)
+}
+
+// Make short-lived ticket which lets user open websocket connection to ws_server.
+// Ticket is "<base64 JSON of WebSocketIdentity>.<base64 HMAC-SHA256 of it>".
+func IssueWebSocketTicket(appConfig *AppConfig, login string, sessionKey string) (string, error) {
+	data, err := json.Marshal(&WebSocketIdentity{
+		Login:      login,
+		SessionKey: sessionKey,
+		Expiry:     time.Now().Add(WebSocketTicketTTL(appConfig)).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + signTicket(appConfig, payload), nil
+}
+
+// Check ticket signature and expiry. Return ErrBadTicket if ticket is not valid.
+func VerifyWebSocketTicket(appConfig *AppConfig, ticket string) (*WebSocketIdentity, error) {
+	parts := strings.Split(ticket, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signTicket(appConfig, parts[0]))) {
+		return nil, ErrBadTicket
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrBadTicket
+	}
+	var identity WebSocketIdentity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, ErrBadTicket
+	}
+	if identity.Login == "" || identity.Expiry < time.Now().Unix() {
+		return nil, ErrBadTicket
+	}
+	return &identity, nil
+}
@@ -0,0 +1,80 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketTicket(t *testing.T) {
+	appConfig := &AppConfig{WebSocketTicketSecret: strings.Repeat("t", minSecretLength), WebSocketTicketSeconds: 60}
+	ticket, err := IssueWebSocketTicket(appConfig, "user", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := VerifyWebSocketTicket(appConfig, ticket)
+	if err != nil || identity.Login != "user" || identity.SessionKey != "key" {
+		t.Errorf("ticket is verified as %+v, %v", identity, err)
+	}
+
+	for _, bad := range []string{"", "abc", ticket + "x", "x" + ticket, strings.Replace(ticket, ".", "..", 1)} {
+		if _, err := VerifyWebSocketTicket(appConfig, bad); err != ErrBadTicket {
+			t.Errorf("VerifyWebSocketTicket(%q): error is %v", bad, err)
+		}
+	}
+	otherConfig := &AppConfig{WebSocketTicketSecret: strings.Repeat("o", minSecretLength)}
+	if _, err := VerifyWebSocketTicket(otherConfig, ticket); err != ErrBadTicket {
+		t.Errorf("ticket signed with other secret: error is %v", err)
+	}
+
+	data, _ := json.Marshal(&WebSocketIdentity{Login: "user", Expiry: time.Now().Add(-time.Second).Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	expired := payload + "." + signTicket(appConfig, payload)
+	if _, err := VerifyWebSocketTicket(appConfig, expired); err != ErrBadTicket {
+		t.Errorf("expired ticket: error is %v", err)
+	}
+}
+
+func TestTicketSubprotocols(t *testing.T) {
+	appConfig := &AppConfig{WebSocketTicketSecret: strings.Repeat("t", minSecretLength)}
+	ticket, err := IssueWebSocketTicket(appConfig, "user", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	protocols := TicketSubprotocols(ticket)
+	if protocols[0] != WebSocketSubprotocol {
+		t.Errorf("first subprotocol is %q, want %q", protocols[0], WebSocketSubprotocol)
+	}
+	// Header tokens may not contain separators.
+	for _, protocol := range protocols {
+		if strings.ContainsAny(protocol, " \t,;=\"()/:<>?@[\\]{}") {
+			t.Errorf("subprotocol %q is not a token", protocol)
+		}
+	}
+	if got := TicketFromSubprotocols(protocols); got != ticket {
+		t.Errorf("ticket is %q, want %q", got, ticket)
+	}
+	if got := TicketFromSubprotocols([]string{WebSocketSubprotocol}); got != "" {
+		t.Errorf("ticket without ticket subprotocol is %q", got)
+	}
+}
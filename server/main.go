@@ -19,13 +19,21 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"github.com/go-redis/redis"
 	"github.com/pbsphp/ShittyPixels/common"
-	"golang.org/x/crypto/bcrypt"
 	"html/template"
+	"image"
+	"image/png"
 	"log"
-	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,9 +43,15 @@ var templates = template.Must(
 		"templates/register.html",
 		"templates/login.html",
 		"templates/canvas.html",
+		"templates/lockouts.html",
 	),
 )
 
+// Print error message with [ ERROR ] prefix and description.
+func logError(description string, err error) {
+	log.Println("[ ERROR ]: ", description, err)
+}
+
 func renderTemplate(w http.ResponseWriter, tmpl string, p interface{}) {
 	err := templates.ExecuteTemplate(w, tmpl+".html", p)
 	if err != nil {
@@ -45,25 +59,77 @@ func renderTemplate(w http.ResponseWriter, tmpl string, p interface{}) {
 	}
 }
 
-func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(bytes), err
+// Password hashers configured in main.
+var passwords *common.Passwords
+
+// Random token (session id, CSRF token): 256 bits from crypto/rand, base64 encoded.
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func checkPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+// IP address of request. It is taken from ClientIPHeader if server is behind proxy.
+// Only the last entry of header is used: it is added by our proxy, entries before it come from client.
+func clientIP(r *http.Request, appConfig *common.AppConfig) string {
+	if appConfig.ClientIPHeader != "" {
+		values := r.Header[http.CanonicalHeaderKey(appConfig.ClientIPHeader)]
+		if len(values) > 0 {
+			entries := strings.Split(values[len(values)-1], ",")
+			if ip := net.ParseIP(strings.TrimSpace(entries[len(entries)-1])); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
-func generateSessionToken() string {
-	letters := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-	tokenLength := 32
+// CSRF token for forms. Token is made on first use. Logged in user keeps it in session,
+// anonymous visitor gets it in signed cookie, so showing login form does not create session.
+func csrfToken(
+	w http.ResponseWriter,
+	r *http.Request,
+	session *common.SessionData,
+	appConfig *common.AppConfig,
+) (string, error) {
+	if session.Login == "" {
+		if token := common.RequestCsrfToken(appConfig, r); token != "" {
+			return token, nil
+		}
+		token, err := generateToken()
+		if err != nil {
+			return "", err
+		}
+		http.SetCookie(w, common.NewCsrfCookie(appConfig, token))
+		return token, nil
+	}
+
+	if session.CsrfToken == "" {
+		token, err := generateToken()
+		if err != nil {
+			return "", err
+		}
+		session.CsrfToken = token
+	}
+	return session.CsrfToken, nil
+}
 
-	b := make([]rune, tokenLength)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+// Give session new id, so id known before login (or logout) is worthless after it.
+// Old session is deleted and new cookie is set by makeHandler.
+func renewSessionId(session *common.SessionData) error {
+	sessionId, err := generateToken()
+	if err != nil {
+		return err
 	}
-	return string(b)
+	session.Id = sessionId
+	session.CreatedAt = time.Now().Unix()
+	return nil
 }
 
 func indexHandler(
@@ -73,10 +139,26 @@ func indexHandler(
 	session *common.SessionData,
 	appConfig *common.AppConfig,
 ) {
+	// Logout form needs CSRF token.
+	var token string
+	if session.Login != "" {
+		var err error
+		if token, err = csrfToken(w, r, session, appConfig); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	context := struct {
-		User string
+		User      string
+		IsAdmin   bool
+		Canvases  []common.CanvasConfig
+		CsrfToken string
 	}{
-		User: session.Login,
+		User:      session.Login,
+		IsAdmin:   appConfig.IsAdmin(session.Login),
+		Canvases:  appConfig.Canvases,
+		CsrfToken: token,
 	}
 
 	renderTemplate(w, "index", &context)
@@ -91,63 +173,85 @@ func registerHandler(
 ) {
 	if session.Login != "" {
 		http.Redirect(w, r, "/canvas", 302)
+		return
 	}
 
 	if r.Method == "POST" {
+		if !common.CheckCsrfToken(appConfig, r, session) {
+			http.Error(w, "bad CSRF token, reload the form", http.StatusForbidden)
+			return
+		}
 		login := r.FormValue("login")
 		password := r.FormValue("password")
 
 		validationErrors := make(map[string]string)
 		isValid := true
 
-		user, err := common.GetUserByLogin(rdb, login)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if user != nil {
-			validationErrors["login"] = "User already exists"
+		if message := appConfig.ValidateLogin(login); message != "" {
+			validationErrors["login"] = message
 			isValid = false
 		}
-		if login == "" {
-			validationErrors["login"] = "Login is empty"
-			isValid = false
-		}
-		if password == "" {
-			validationErrors["password"] = "Password is empty"
+		if message := passwords.ValidatePassword(login, password); message != "" {
+			validationErrors["password"] = message
 			isValid = false
 		}
 
 		if isValid {
-			passHash, err := hashPassword(password)
+			algorithm, passHash, err := passwords.Hash(password)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 
-			err = common.StoreUser(rdb, &common.UserData{
-				Login:        login,
-				PasswordHash: passHash,
+			created, err := common.CreateUser(rdb, &common.UserData{
+				Login:             common.DisplayLogin(login),
+				PasswordHash:      passHash,
+				PasswordAlgorithm: algorithm,
 			})
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			if !created {
+				validationErrors["login"] = "User already exists"
+				isValid = false
+			}
+		}
+
+		if isValid {
 			http.Redirect(w, r, "/login", 302)
 		} else {
 			session.ValidationErrors = validationErrors
 			http.Redirect(w, r, "/register", 302)
 		}
 	} else {
+		token, err := csrfToken(w, r, session, appConfig)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		renderTemplate(w, "register", &struct {
 			ValidationErrors map[string]string
+			CsrfToken        string
 		}{
 			ValidationErrors: session.ValidationErrors,
+			CsrfToken:        token,
 		})
 		session.ValidationErrors = make(map[string]string)
 	}
 }
 
+// Replace password hash of user with one made by current hasher.
+func rehashPassword(rdb *redis.Client, user *common.UserData, password string) error {
+	algorithm, hash, err := passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	user.PasswordAlgorithm = algorithm
+	user.PasswordHash = hash
+	return common.StoreUser(rdb, user)
+}
+
 func loginHandler(
 	w http.ResponseWriter,
 	r *http.Request,
@@ -157,24 +261,21 @@ func loginHandler(
 ) {
 	if session.Login != "" {
 		http.Redirect(w, r, "/canvas", 302)
+		return
 	}
 
 	if r.Method == "POST" {
+		if !common.CheckCsrfToken(appConfig, r, session) {
+			http.Error(w, "bad CSRF token, reload the form", http.StatusForbidden)
+			return
+		}
 		login := r.FormValue("login")
 		password := r.FormValue("password")
+		ip := clientIP(r, appConfig)
 
 		validationErrors := make(map[string]string)
 		isValid := true
 
-		user, err := common.GetUserByLogin(rdb, login)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if user == nil {
-			validationErrors["login"] = "User not found"
-			isValid = false
-		}
 		if login == "" {
 			validationErrors["login"] = "Login is empty"
 			isValid = false
@@ -182,29 +283,87 @@ func loginHandler(
 		if password == "" {
 			validationErrors["password"] = "Password is empty"
 			isValid = false
-		}
-		if user != nil && !checkPasswordHash(password, user.PasswordHash) {
-			validationErrors["password"] = "Wrong password"
+		} else if passwords.TooLong(password) {
+			// Nobody has such password, it is not worth hashing.
+			validationErrors["password"] = "Password is too long"
 			isValid = false
 		}
+		if isValid {
+			lockState, err := common.GetLoginLockState(rdb, common.NormalizeLogin(login), ip)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if locked := lockState.Remaining(); locked > 0 {
+				validationErrors["login"] = fmt.Sprintf(
+					"Too many failed attempts, try again in %d seconds", int((locked+time.Second-1)/time.Second))
+				isValid = false
+			}
+		}
+
+		var user *common.UserData
+		if isValid {
+			var err error
+			user, err = common.GetUserByLogin(rdb, login)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// Same message and (roughly) same time for unknown login and wrong password,
+			// so they can not be told apart.
+			ok, needsRehash, err := passwords.Verify(user, password)
+			if err != nil {
+				logError("verify password", err)
+			}
+			if !ok {
+				validationErrors["login"] = "Wrong login or password"
+				isValid = false
+				if err := common.RegisterLoginFailure(rdb, appConfig, common.NormalizeLogin(login), ip); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			} else if err := common.ClearLoginFailures(rdb, common.LockoutByLogin, common.NormalizeLogin(login)); err != nil {
+				logError("clear login failures", err)
+			}
+			// Old hashes are upgraded to current algorithm and costs while password is known.
+			if ok && needsRehash {
+				if err := rehashPassword(rdb, user, password); err != nil {
+					logError("rehash password", err)
+				}
+			}
+		}
 
 		if user != nil && isValid {
+			if err := renewSessionId(session); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 			session.Login = user.Login
+			// Forms of anonymous visitor should not work for logged in user.
+			session.CsrfToken = ""
 			http.Redirect(w, r, "/canvas", 302)
 		} else {
 			session.ValidationErrors = validationErrors
 			http.Redirect(w, r, "/login", 302)
 		}
 	} else {
+		token, err := csrfToken(w, r, session, appConfig)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		renderTemplate(w, "login", &struct {
 			ValidationErrors map[string]string
+			CsrfToken        string
 		}{
 			ValidationErrors: session.ValidationErrors,
+			CsrfToken:        token,
 		})
 		session.ValidationErrors = make(map[string]string)
 	}
 }
 
+// Logout form. POST only, so links and images on other sites can not log user out.
 func logoutHandler(
 	w http.ResponseWriter,
 	r *http.Request,
@@ -212,11 +371,90 @@ func logoutHandler(
 	session *common.SessionData,
 	appConfig *common.AppConfig,
 ) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !common.CheckCsrfToken(appConfig, r, session) {
+		http.Error(w, "bad CSRF token, reload the page", http.StatusForbidden)
+		return
+	}
+	if err := renewSessionId(session); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	session.Login = ""
+	session.CsrfToken = ""
 	session.ValidationErrors = map[string]string{}
 	http.Redirect(w, r, "/", 302)
 }
 
+// Failed logins and locks. Admins only.
+// GET /admin/lockouts shows them, POST /admin/lockouts with `kind' and `subject' clears one of them.
+func lockoutsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	rdb *redis.Client,
+	session *common.SessionData,
+	appConfig *common.AppConfig,
+) {
+	if !appConfig.IsAdmin(session.Login) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == "POST" {
+		if !common.CheckCsrfToken(appConfig, r, session) {
+			http.Error(w, "bad CSRF token, reload the page", http.StatusForbidden)
+			return
+		}
+		kind := r.FormValue("kind")
+		if kind != common.LockoutByLogin && kind != common.LockoutByIP {
+			http.Error(w, "unknown lockout kind", http.StatusBadRequest)
+			return
+		}
+		err := common.ClearLoginFailures(rdb, kind, r.FormValue("subject"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("lockout of %s %s cleared by %s\n", kind, r.FormValue("subject"), session.Login)
+		http.Redirect(w, r, "/admin/lockouts", 302)
+		return
+	}
+
+	lockouts, err := common.ListLoginLockouts(rdb)
+	if err != nil {
+		logError("list lockouts", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token, err := csrfToken(w, r, session, appConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "lockouts", &struct {
+		Lockouts  []common.LoginLockout
+		CsrfToken string
+	}{
+		Lockouts:  lockouts,
+		CsrfToken: token,
+	})
+}
+
+// Get canvas from `canvas' request parameter. First canvas is used if parameter is not set.
+// Return nil if there is no such canvas.
+func requestCanvas(r *http.Request, appConfig *common.AppConfig) *common.CanvasConfig {
+	name := r.FormValue("canvas")
+	if name == "" {
+		return &appConfig.Canvases[0]
+	}
+	return appConfig.GetCanvas(name)
+}
+
+// Canvas page. URL is /canvas/<canvas name>. Plain /canvas leads to first canvas.
 func canvasHandler(
 	w http.ResponseWriter,
 	r *http.Request,
@@ -226,64 +464,449 @@ func canvasHandler(
 ) {
 	if session.Login == "" {
 		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/canvas")
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		http.Redirect(w, r, "/canvas/"+appConfig.Canvases[0].Name, 302)
+		return
+	}
+	canvasIndex := -1
+	for i := range appConfig.Canvases {
+		if appConfig.Canvases[i].Name == name {
+			canvasIndex = i
+		}
+	}
+	if canvasIndex < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	shardMap, err := common.GetShardMap(rdb, &appConfig.Canvases[canvasIndex], appConfig.ShardCount)
+	if err != nil {
+		logError("get shard map", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Browser connects to instances directly only if there is no gateway.
+	var shardAddresses []string
+	if appConfig.GatewayAddress == "" {
+		shardAddresses, err = common.GetShardAddresses(rdb, shardMap.Layout.Shards)
+		if err != nil {
+			logError("get shard addresses", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	ticket, err := common.IssueWebSocketTicket(appConfig, session.Login, common.SessionKey(session.Id))
+	if err != nil {
+		logError("issue websocket ticket", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	context := struct {
-		Config       *common.AppConfig
-		SessionToken string
+		Config      *common.AppConfig
+		Canvas      *common.CanvasConfig
+		CanvasIndex int
+		ShardMap    *common.ShardMap
+		// Address of instance holding each shard (empty with gateway).
+		ShardAddresses []string
+		// Lets browser open websocket connections (see common.IssueWebSocketTicket).
+		WebSocketTicket string
 	}{
-		Config:       appConfig,
-		SessionToken: session.Id,
+		Config:          appConfig,
+		Canvas:          &appConfig.Canvases[canvasIndex],
+		CanvasIndex:     canvasIndex,
+		ShardMap:        shardMap,
+		ShardAddresses:  shardAddresses,
+		WebSocketTicket: ticket,
 	}
 	renderTemplate(w, "canvas", context)
 }
 
+// Who placed pixel and when.
+// GET /pixel?canvas=<canvas name>&x=<X coordinate>&y=<Y coordinate>
+// Response is JSON: {"x": x, "y": y, "login": "<login>", "time": <unix time in milliseconds>}.
+// Respond 404 if nobody has placed this pixel yet.
+func pixelInfoHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	rdb *redis.Client,
+	session *common.SessionData,
+	appConfig *common.AppConfig,
+) {
+	canvasConfig := requestCanvas(r, appConfig)
+	if canvasConfig == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	shardMap, err := common.GetShardMap(rdb, canvasConfig, appConfig.ShardCount)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	x, errX := strconv.Atoi(r.FormValue("x"))
+	y, errY := strconv.Atoi(r.FormValue("y"))
+	if errX != nil || errY != nil ||
+		x < 0 || x >= shardMap.Layout.Width || y < 0 || y >= shardMap.Layout.Height {
+		http.Error(w, "expected x and y inside canvas", http.StatusBadRequest)
+		return
+	}
+
+	attribution, err := common.GetPixelAttribution(rdb, canvasConfig.Name, x, y)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if attribution == nil {
+		http.Error(w, "pixel was not placed yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		X     int    `json:"x"`
+		Y     int    `json:"y"`
+		Login string `json:"login"`
+		Time  int64  `json:"time"`
+	}{
+		X:     x,
+		Y:     y,
+		Login: attribution.Login,
+		Time:  attribution.Time,
+	})
+	if err != nil {
+		logError("write pixel info", err)
+	}
+}
+
+// New ticket for opening websocket connections. Canvas page asks for it before previous one expires.
+// GET /ws-ticket
+// Response is JSON: {"ticket": "<ticket>"}.
+// Respond 403 if user is not logged in.
+func webSocketTicketHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	rdb *redis.Client,
+	session *common.SessionData,
+	appConfig *common.AppConfig,
+) {
+	if session.Login == "" {
+		http.Error(w, "log in first", http.StatusForbidden)
+		return
+	}
+
+	ticket, err := common.IssueWebSocketTicket(appConfig, session.Login, common.SessionKey(session.Id))
+	if err != nil {
+		logError("issue websocket ticket", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		Ticket string `json:"ticket"`
+	}{
+		Ticket: ticket,
+	})
+	if err != nil {
+		logError("write websocket ticket", err)
+	}
+}
+
+// Addresses of instances holding canvas shards. Browser asks for them when instance is lost (see RunReplica).
+// GET /shards?canvas=<canvas name>
+// Response is JSON: {"version": <shard map version>, "addresses": ["<address of shard 0>", ...]}.
+// Respond 404 if browser connects through gateway.
+func shardsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	rdb *redis.Client,
+	session *common.SessionData,
+	appConfig *common.AppConfig,
+) {
+	canvasConfig := requestCanvas(r, appConfig)
+	if canvasConfig == nil || appConfig.GatewayAddress != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	shardMap, err := common.GetShardMap(rdb, canvasConfig, appConfig.ShardCount)
+	if err != nil {
+		logError("get shard map", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	addresses, err := common.GetShardAddresses(rdb, shardMap.Layout.Shards)
+	if err != nil {
+		logError("get shard addresses", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		Version   int64    `json:"version"`
+		Addresses []string `json:"addresses"`
+	}{
+		Version:   shardMap.Version,
+		Addresses: addresses,
+	})
+	if err != nil {
+		logError("write shards", err)
+	}
+}
+
+// Max scale factor for canvas image export.
+const maxExportScale = 16
+
+// Assembled canvas is reused for that long, so /canvas.png does not read all checkpoints
+// and logs on every request.
+const canvasImageCacheTTL = 5 * time.Second
+
+// Canvases assembled for /canvas.png by canvas name. Entry is dropped when it gets older than
+// canvasImageCacheTTL or shard map version changes.
+var canvasImageCache = struct {
+	sync.Mutex
+	entries map[string]*cachedCanvas
+}{entries: make(map[string]*cachedCanvas)}
+
+type cachedCanvas struct {
+	mapVersion int64
+	loadedAt   time.Time
+	canvas     []byte
+	layout     *common.CanvasLayout
+}
+
+// Assemble canvas or take it from cache. Only one canvas is assembled at a time.
+// Returned layout is the one canvas was assembled with, its Width and Height give canvas dimensions.
+func loadCachedCanvas(
+	rdb *redis.Client,
+	appConfig *common.AppConfig,
+	canvasConfig *common.CanvasConfig,
+) ([]byte, *common.CanvasLayout, error) {
+	shardMap, err := common.GetShardMap(rdb, canvasConfig, appConfig.ShardCount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	canvasImageCache.Lock()
+	defer canvasImageCache.Unlock()
+	entry := canvasImageCache.entries[canvasConfig.Name]
+	if entry != nil && entry.mapVersion == shardMap.Version && time.Since(entry.loadedAt) < canvasImageCacheTTL {
+		return entry.canvas, entry.layout, nil
+	}
+	canvas, err := common.AssembleCanvas(rdb, canvasConfig, shardMap.Layout)
+	if err != nil {
+		return nil, nil, err
+	}
+	canvasImageCache.entries[canvasConfig.Name] = &cachedCanvas{
+		mapVersion: shardMap.Version,
+		loadedAt:   time.Now(),
+		canvas:     canvas,
+		layout:     shardMap.Layout,
+	}
+	return canvas, shardMap.Layout, nil
+}
+
+// Max number of /canvas.png images rendered at the same time. Requests above it get 429.
+const maxConcurrentCanvasImages = 4
+
+var canvasImageSlots = make(chan struct{}, maxConcurrentCanvasImages)
+
+// Whole canvas as PNG image.
+// GET /canvas.png?canvas=<canvas name>&scale=<pixel size>&x=<left>&y=<top>&w=<width>&h=<height>
+// All parameters are optional. By default whole first canvas is exported with scale 1.
+// Image may be up to canvasImageCacheTTL old.
+func canvasImageHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	rdb *redis.Client,
+	appConfig *common.AppConfig,
+) {
+	canvasConfig := requestCanvas(r, appConfig)
+	if canvasConfig == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	select {
+	case canvasImageSlots <- struct{}{}:
+		defer func() { <-canvasImageSlots }()
+	default:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "too many canvas images are being rendered, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	canvas, layout, err := loadCachedCanvas(rdb, appConfig, canvasConfig)
+	if err != nil {
+		logError("load canvas", err)
+		http.Error(w, "canvas is not available", http.StatusServiceUnavailable)
+		return
+	}
+	width := layout.Width
+	height := layout.Height
+
+	intParam := func(name string, defaultValue int) (int, bool) {
+		raw := r.FormValue(name)
+		if raw == "" {
+			return defaultValue, true
+		}
+		val, err := strconv.Atoi(raw)
+		return val, err == nil
+	}
+	scale, okScale := intParam("scale", 1)
+	left, okX := intParam("x", 0)
+	top, okY := intParam("y", 0)
+	regionWidth, okW := intParam("w", width)
+	regionHeight, okH := intParam("h", height)
+	if !okScale || !okX || !okY || !okW || !okH {
+		http.Error(w, "expected integer parameters", http.StatusBadRequest)
+		return
+	}
+	if scale < 1 || scale > maxExportScale {
+		http.Error(w, "scale is out of range", http.StatusBadRequest)
+		return
+	}
+	region := image.Rect(left, top, left+regionWidth, top+regionHeight).Intersect(image.Rect(0, 0, width, height))
+	if region.Empty() {
+		http.Error(w, "region is outside of canvas", http.StatusBadRequest)
+		return
+	}
+
+	img := image.NewPaletted(
+		image.Rect(0, 0, region.Dx()*scale, region.Dy()*scale),
+		common.MakePalette(canvasConfig.PaletteColors),
+	)
+	for y := 0; y < img.Rect.Dy(); y++ {
+		canvasY := region.Min.Y + y/scale
+		for x := 0; x < img.Rect.Dx(); x++ {
+			canvasX := region.Min.X + x/scale
+			img.SetColorIndex(x, y, canvas[canvasY*width+canvasX])
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, img); err != nil {
+		logError("encode canvas image", err)
+	}
+}
+
+// Same as makeHandler, but for handlers which do not need user session.
+func makePublicHandler(
+	fn func(w http.ResponseWriter, r *http.Request, rdb *redis.Client, appConfig *common.AppConfig),
+	rdb *redis.Client,
+	appConfig *common.AppConfig,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fn(w, r, rdb, appConfig)
+	}
+}
+
+// Response writer which calls `beforeWrite' once before response headers are sent.
+type sessionResponseWriter struct {
+	http.ResponseWriter
+	beforeWrite func()
+	written     bool
+}
+
+func (w *sessionResponseWriter) flushSession() {
+	if !w.written {
+		w.written = true
+		w.beforeWrite()
+	}
+}
+
+func (w *sessionResponseWriter) WriteHeader(statusCode int) {
+	w.flushSession()
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *sessionResponseWriter) Write(b []byte) (int, error) {
+	w.flushSession()
+	return w.ResponseWriter.Write(b)
+}
+
+// Wrap handler which needs user session. Session is prolonged on every request (see common.SessionTTL).
+// New session is stored and gets cookie only when handler puts something into it,
+// so visitors who do nothing do not leave sessions in redis.
 func makeHandler(
 	fn func(w http.ResponseWriter, r *http.Request, rdb *redis.Client, session *common.SessionData, appConfig *common.AppConfig),
 	rdb *redis.Client,
 	appConfig *common.AppConfig,
 ) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("sessionId")
-		if err != nil && err != http.ErrNoCookie {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
 		var session *common.SessionData
-		if cookie != nil {
-			session, err = common.GetSessionBySessionId(rdb, cookie.Value)
+		var err error
+		if sessionId := common.RequestSessionId(appConfig, r); sessionId != "" {
+			session, err = common.GetSessionBySessionId(rdb, sessionId)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 		}
-		if session == nil {
+		isNew := session == nil
+		if isNew {
+			sessionId, err := generateToken()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 			session = &common.SessionData{
 				Login:            "",
-				Id:               generateSessionToken(),
+				Id:               sessionId,
 				ValidationErrors: make(map[string]string),
+				CreatedAt:        time.Now().Unix(),
 			}
-			http.SetCookie(w, &http.Cookie{
-				Name:  "sessionId",
-				Value: session.Id,
-				Path:  "/",
-			})
+		}
+		if session.CreatedAt == 0 {
+			// Session was stored before sessions got expiry.
+			session.CreatedAt = time.Now().Unix()
 		}
 
-		fn(w, r, rdb, session, appConfig)
+		// Handler may give session new id (see renewSessionId).
+		originalId := session.Id
+		sw := &sessionResponseWriter{
+			ResponseWriter: w,
+			beforeWrite: func() {
+				renewed := session.Id != originalId
+				if (isNew || renewed) && !session.IsEmpty() {
+					http.SetCookie(w, common.NewSessionCookie(appConfig, session.Id, common.SessionExpiry(appConfig, session)))
+				} else if renewed && !isNew {
+					http.SetCookie(w, common.ExpiredSessionCookie(appConfig))
+				}
+			},
+		}
+		fn(sw, r, rdb, session, appConfig)
+		sw.flushSession()
 
-		err = common.StoreSession(rdb, session)
+		if !isNew && session.Id != originalId {
+			if err := common.DeleteSession(rdb, originalId); err != nil {
+				logError("delete old session", err)
+			}
+		}
+		if session.IsEmpty() {
+			if !isNew && session.Id == originalId {
+				err = common.DeleteSession(rdb, session.Id)
+			}
+		} else {
+			err = common.StoreSession(rdb, appConfig, session)
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			logError("store session", err)
 		}
 	}
 }
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
-
 	appConfig := common.MustReadAppConfig("config.json")
+	passwords = common.MustNewPasswords(appConfig)
 
 	rdb := redis.NewClient(&redis.Options{
 		Addr:     appConfig.RedisAddress,
@@ -291,11 +914,26 @@ func main() {
 		DB:       appConfig.RedisDatabase,
 	})
 
+	collisions, err := common.MigrateUserKeys(rdb)
+	if err != nil {
+		log.Fatal("migrate user keys: ", err)
+	}
+	for _, key := range collisions {
+		log.Printf("user %s collides with other user after login normalization, rename it by hand", key)
+	}
+
 	http.HandleFunc("/", makeHandler(indexHandler, rdb, appConfig))
 	http.HandleFunc("/register", makeHandler(registerHandler, rdb, appConfig))
 	http.HandleFunc("/login", makeHandler(loginHandler, rdb, appConfig))
 	http.HandleFunc("/logout", makeHandler(logoutHandler, rdb, appConfig))
+	http.HandleFunc("/admin/lockouts", makeHandler(lockoutsHandler, rdb, appConfig))
 	http.HandleFunc("/canvas", makeHandler(canvasHandler, rdb, appConfig))
+	http.HandleFunc("/canvas/", makeHandler(canvasHandler, rdb, appConfig))
+	http.HandleFunc("/pixel", makeHandler(pixelInfoHandler, rdb, appConfig))
+	http.HandleFunc("/shards", makeHandler(shardsHandler, rdb, appConfig))
+	http.HandleFunc("/ws-ticket", makeHandler(webSocketTicketHandler, rdb, appConfig))
+	http.HandleFunc("/canvas.png", makePublicHandler(canvasImageHandler, rdb, appConfig))
+	http.HandleFunc("/timelapse.gif", makePublicHandler(timelapseHandler, rdb, appConfig))
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
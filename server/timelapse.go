@@ -0,0 +1,218 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/go-redis/redis"
+	"github.com/pbsphp/ShittyPixels/common"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Limits for timelapse size. Rendering takes CPU time proportional to total number of pixels.
+const (
+	maxTimelapseFrames = 500
+	maxTimelapsePixels = 64 * 1024 * 1024
+	// Timelapses rendered at the same time. Others are rejected with 429.
+	maxConcurrentTimelapses = 2
+)
+
+var timelapseSlots = make(chan struct{}, maxConcurrentTimelapses)
+
+// Animated GIF with canvas history. Starts from initial image, so it needs whole placement log
+// (see TrimPlacementLog setting).
+// GET /timelapse.gif?canvas=<canvas name>&from=<unix time>&to=<unix time>&interval=<seconds>&scale=<pixel size>&delay=<milliseconds>
+// canvas -- canvas name (default: first canvas).
+// from, to -- time range (default: from first placement till now).
+// interval -- canvas time between frames in seconds (default: 60).
+// scale -- pixel size (default: 1).
+// delay -- frame duration in milliseconds (default: 100).
+func timelapseHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	rdb *redis.Client,
+	appConfig *common.AppConfig,
+) {
+	// Placements included into checkpoints are dropped from log.
+	if appConfig.TrimPlacementLog {
+		http.Error(w, "timelapse is disabled, see TrimPlacementLog", http.StatusNotFound)
+		return
+	}
+	canvasConfig := requestCanvas(r, appConfig)
+	if canvasConfig == nil {
+		http.NotFound(w, r)
+		return
+	}
+	width := canvasConfig.CanvasCols
+	height := canvasConfig.CanvasRows
+
+	int64Param := func(name string, defaultValue int64) (int64, bool) {
+		raw := r.FormValue(name)
+		if raw == "" {
+			return defaultValue, true
+		}
+		val, err := strconv.ParseInt(raw, 10, 64)
+		return val, err == nil
+	}
+
+	// Parameters are checked before anything is read from redis.
+	// Default `from' needs first placement time, it is checked again when it is known.
+	now := time.Now().Unix()
+	from, okFrom := int64Param("from", -1)
+	to, okTo := int64Param("to", now)
+	interval, okInterval := int64Param("interval", 60)
+	scale, okScale := int64Param("scale", 1)
+	delay, okDelay := int64Param("delay", 100)
+	if !okFrom || !okTo || !okInterval || !okScale || !okDelay {
+		http.Error(w, "expected integer parameters", http.StatusBadRequest)
+		return
+	}
+	if interval <= 0 || delay <= 0 || delay > 655350 {
+		http.Error(w, "expected positive interval and delay up to 655350", http.StatusBadRequest)
+		return
+	}
+	if scale < 1 || scale > maxExportScale {
+		http.Error(w, "scale is out of range", http.StatusBadRequest)
+		return
+	}
+	if int64(width)*scale > common.MaxGifSide || int64(height)*scale > common.MaxGifSide {
+		http.Error(w, "timelapse is too large, decrease scale", http.StatusBadRequest)
+		return
+	}
+	checkRange := func() bool {
+		if from > to {
+			http.Error(w, "expected from <= to", http.StatusBadRequest)
+			return false
+		}
+		framesCount := (to-from)/interval + 1
+		if framesCount > maxTimelapseFrames ||
+			framesCount*int64(width*height)*scale*scale > maxTimelapsePixels {
+			http.Error(w, "too many frames, increase interval or decrease scale", http.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+	if r.FormValue("from") != "" && !checkRange() {
+		return
+	}
+
+	select {
+	case timelapseSlots <- struct{}{}:
+		defer func() { <-timelapseSlots }()
+	default:
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "too many timelapses are being rendered, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	shardMap, err := common.GetShardMap(rdb, canvasConfig, appConfig.ShardCount)
+	if err != nil {
+		logError("get shard map", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Log was trimmed before, frames would miss placements made before first logged one.
+	trimmed, err := common.PlacementLogTrimmed(rdb, canvasConfig.Name)
+	if err != nil {
+		logError("check placement log", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if trimmed {
+		http.Error(w, "placement log was trimmed, timelapse is not available", http.StatusGone)
+		return
+	}
+	if r.FormValue("from") == "" {
+		first, found, err := common.FirstPlacementTime(rdb, canvasConfig.Name, shardMap.MaxShards)
+		if err != nil {
+			logError("get first placement time", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		from = to
+		if found {
+			from = first / 1000
+		}
+		if !checkRange() {
+			return
+		}
+	}
+
+	canvas, err := common.ReadInitialImage(canvasConfig.InitialImage, canvasConfig.PaletteColors, width, height)
+	if err != nil {
+		logError("read initial image", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	palette := common.MakePalette(canvasConfig.PaletteColors)
+	framesCount := (to-from)/interval + 1
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"timelapse.gif\"")
+	// Frames are encoded one by one right into response, only current canvas state is kept in memory.
+	gw := common.NewGifStreamWriter(w, width*int(scale), height*int(scale), palette)
+	// GIF delay is in 100ths of a second.
+	gifDelay := int((delay + 9) / 10)
+	row := make([]byte, width*int(scale))
+	writeFrame := func() error {
+		return gw.WriteFrame(gifDelay, func(lw io.Writer) error {
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					for i := 0; i < int(scale); i++ {
+						row[x*int(scale)+i] = canvas[y*width+x]
+					}
+				}
+				for i := 0; i < int(scale); i++ {
+					if _, err := lw.Write(row); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	}
+
+	frame := int64(0)
+	// Frame is written when first placement made after its time is met, so placements are read once.
+	err = common.ForEachPlacementUntil(rdb, canvasConfig.Name, shardMap.MaxShards, to*1000, func(event *common.PlacementEvent) error {
+		for ; frame < framesCount && event.Time > (from+frame*interval)*1000; frame++ {
+			if err := writeFrame(); err != nil {
+				return err
+			}
+		}
+		if event.X >= 0 && event.X < width && event.Y >= 0 && event.Y < height &&
+			int(event.Color) < len(palette) {
+			canvas[event.Y*width+event.X] = event.Color
+		}
+		return nil
+	})
+	for ; err == nil && frame < framesCount; frame++ {
+		err = writeFrame()
+	}
+	if err == nil {
+		err = gw.Close()
+	}
+	if err != nil {
+		// Response is already started, nothing can be reported to client.
+		logError("render timelapse", err)
+	}
+}
@@ -17,6 +17,13 @@
 
 const PIXEL_SIZE = 10;
 
+// Binary protocol message kinds (see ws_server/protocol.go).
+const BINARY_KIND_SNAPSHOT = 1;
+const BINARY_KIND_PIXEL_BATCH = 3;
+
+// Delay before reconnecting to lost instance or gateway, milliseconds.
+const RECONNECT_DELAY = 1000;
+
 
 class CanvasWrapper {
     constructor(canvas) {
@@ -37,78 +44,355 @@ class CanvasWrapper {
 
 
 class Controller {
-    constructor(config, sessionToken, canvas, paletteWidget, timerWidget) {
+    constructor(config, canvas, paletteWidget, timerWidget, pixelInfoWidget) {
         this.connect = this.connect.bind(this);
+        this.openConnection = this.openConnection.bind(this);
+        this.updateConnections = this.updateConnections.bind(this);
+        this.refreshTicket = this.refreshTicket.bind(this);
+        this.handleConnectionLost = this.handleConnectionLost.bind(this);
+        this.refreshAddresses = this.refreshAddresses.bind(this);
         this.handleMessage = this.handleMessage.bind(this);
+        this.handleBinaryMessage = this.handleBinaryMessage.bind(this);
         this.handleCanvasClick = this.handleCanvasClick.bind(this);
+        this.handleCanvasContextMenu = this.handleCanvasContextMenu.bind(this);
         this.handlePixelColorMessage = this.handlePixelColorMessage.bind(this);
+        this.handlePixelBatchMessage = this.handlePixelBatchMessage.bind(this);
         this.handleAllPixelsColorsMessage = this.handleAllPixelsColorsMessage.bind(this);
+        this.handleResumedMessage = this.handleResumedMessage.bind(this);
         this.handleCooldownInfoMessage = this.handleCooldownInfoMessage.bind(this);
+        this.handlePixelInfoMessage = this.handlePixelInfoMessage.bind(this);
+        this.handleShardMapMessage = this.handleShardMapMessage.bind(this);
 
         this.canvasWrapper = new CanvasWrapper(canvas);
         canvas.onclick = this.handleCanvasClick;
+        canvas.oncontextmenu = this.handleCanvasContextMenu;
         canvas.width = config["CanvasCols"] * PIXEL_SIZE;
         canvas.height = config["CanvasRows"] * PIXEL_SIZE;
 
-        this.connections = [];
-        for (let addr of config["WebSocketAppAddresses"]) {
-            const conn = new WebSocket(addr);
-            conn.onmessage = this.handleMessage;
-            conn.onopen = () => this.connect(conn);
-            this.connections.push(conn);
-        }
-
         this.paletteWidget = paletteWidget;
         this.timerWidget = timerWidget;
+        this.pixelInfoWidget = pixelInfoWidget;
 
-        this.sessionToken = sessionToken;
         this.config = config;
+
+        // Websocket ticket expires soon, keep getting new ones while page is open.
+        const ticketSeconds = config["WebSocketTicketSeconds"] || 60;
+        setInterval(this.refreshTicket, ticketSeconds * 1000 / 2);
+
+        // Per instance: version of last snapshot (null until it arrives),
+        // pixel events received before snapshot, matrix epoch and version of last received event
+        // (to resume after reconnect, see ws_server handleResume).
+        this.states = new Map();
+
+        if (config["GatewayAddress"]) {
+            // Gateway forwards requests to instances and merges their events into one connection.
+            const allInstances = new Set(config["ChunkOwners"]);
+            this.gateway = this.openConnection(config["GatewayAddress"], allInstances);
+        } else {
+            // Connections to instances owning visible chunks, by instance number.
+            this.gateway = null;
+            this.connections = new Map();
+            // Timer of next /shards poll while some visible instance has no address.
+            this.addressRefreshTimer = null;
+            window.addEventListener("scroll", this.updateConnections);
+            window.addEventListener("resize", this.updateConnections);
+            this.updateConnections();
+        }
+    }
+
+    stateOf(instance) {
+        let state = this.states.get(instance);
+        if (state === undefined) {
+            state = {
+                snapshotVersion: null,
+                pendingPixels: [],
+                epoch: null,
+                lastVersion: null,
+            };
+            this.states.set(instance, state);
+        }
+        return state;
+    }
+
+    // Instance owning pixel (x, y).
+    ownerOf(x, y) {
+        const chunkSize = this.config["ChunkSize"];
+        const chunk = Math.floor(y / chunkSize) * this.config["ChunksX"] + Math.floor(x / chunkSize);
+        return this.config["ChunkOwners"][chunk];
+    }
+
+    // Instances owning chunks which are visible in browser window.
+    visibleInstances() {
+        const chunkSize = this.config["ChunkSize"] * PIXEL_SIZE;
+        const chunksX = this.config["ChunksX"];
+        const owners = this.config["ChunkOwners"];
+        const chunksY = owners.length / chunksX;
+        const rect = this.canvasWrapper.canvas.getBoundingClientRect();
+
+        const clamp = (val, max) => Math.min(Math.max(val, 0), max);
+        const fromX = clamp(Math.floor(-rect.left / chunkSize), chunksX - 1);
+        const toX = clamp(Math.floor((window.innerWidth - rect.left) / chunkSize), chunksX - 1);
+        const fromY = clamp(Math.floor(-rect.top / chunkSize), chunksY - 1);
+        const toY = clamp(Math.floor((window.innerHeight - rect.top) / chunkSize), chunksY - 1);
+
+        const instances = new Set();
+        for (let chunkY = fromY; chunkY <= toY; ++chunkY) {
+            for (let chunkX = fromX; chunkX <= toX; ++chunkX) {
+                instances.add(owners[chunkY * chunksX + chunkX]);
+            }
+        }
+        return instances;
     }
 
-    connect(conn) {
+    // Connect to instances owning visible chunks and disconnect from others.
+    // Shard without primary has no address yet, addresses are polled until every visible instance is connected.
+    updateConnections() {
+        const needed = this.visibleInstances();
+        for (let [instance, conn] of this.connections) {
+            if (!needed.has(instance)) {
+                conn.close();
+                this.connections.delete(instance);
+            }
+        }
+        let missing = false;
+        for (let instance of needed) {
+            if (!this.connections.has(instance)) {
+                const addr = this.config["WebSocketAppAddresses"][instance];
+                if (addr) {
+                    this.connections.set(instance, this.openConnection(addr, new Set([instance])));
+                } else {
+                    missing = true;
+                }
+            }
+        }
+        if (missing && this.addressRefreshTimer === null) {
+            this.addressRefreshTimer = setTimeout(() => {
+                this.addressRefreshTimer = null;
+                this.refreshAddresses();
+            }, RECONNECT_DELAY);
+        }
+    }
+
+    refreshTicket() {
+        fetch("/ws-ticket", {credentials: "same-origin"})
+            .then(response => response.ok ? response.json() : null)
+            .then(data => {
+                if (data !== null) {
+                    this.config["WebSocketTicket"] = data.ticket;
+                }
+            })
+            .catch(() => {});
+    }
+
+    // Open connection which will send snapshots of given instances.
+    // Ticket authenticates user (see ws_server authenticate). It is offered as subprotocol,
+    // so it does not appear in URL (see common.TicketSubprotocols).
+    openConnection(addr, instances) {
+        const conn = new WebSocket(addr, ["shittypixels", "ticket." + this.config["WebSocketTicket"]]);
+        conn.binaryType = "arraybuffer";
+        conn.onmessage = this.handleMessage;
+        conn.onopen = () => {
+            // Ask for changes missed since previous connection. Instances we know nothing about send snapshots.
+            const positions = {};
+            for (let instance of instances) {
+                const state = this.states.get(instance);
+                if (state === undefined || state.epoch === null || state.snapshotVersion === null) {
+                    this.states.delete(instance);
+                    continue;
+                }
+                positions[instance] = {epoch: state.epoch, version: state.lastVersion};
+                state.snapshotVersion = null;
+                state.pendingPixels = [];
+            }
+            this.connect(conn, positions);
+        };
+        conn.onclose = () => {
+            setTimeout(() => this.handleConnectionLost(conn, instances), RECONNECT_DELAY);
+        };
+        return conn;
+    }
+
+    // Connection was closed by server or network. Connections we have closed ourselves are not current anymore.
+    // Instance may be replaced by its replica, so ask for current addresses before reconnecting.
+    handleConnectionLost(conn, instances) {
+        if (this.gateway !== null) {
+            if (this.gateway === conn) {
+                this.gateway = this.openConnection(this.config["GatewayAddress"], instances);
+            }
+            return;
+        }
+
+        for (let instance of instances) {
+            if (this.connections.get(instance) !== conn) {
+                return;
+            }
+            this.connections.delete(instance);
+        }
+        this.refreshAddresses();
+    }
+
+    // Refresh instance addresses and connect to instances which are still visible.
+    // Connection to address which is not served anymore fails and brings us here again.
+    refreshAddresses() {
+        fetch("/shards?canvas=" + encodeURIComponent(this.config["CanvasName"]), {credentials: "same-origin"})
+            .then(response => response.ok ? response.json() : null)
+            .then(data => {
+                if (data === null) {
+                    return;
+                }
+                if (data.version === this.config["ShardMapVersion"]) {
+                    this.config["WebSocketAppAddresses"] = data.addresses;
+                } else if (data.version > this.config["ShardMapVersion"]) {
+                    // Canvas was resharded while no instance could tell us, page has to get new layout.
+                    window.location.reload();
+                }
+            })
+            .catch(() => {})
+            .then(this.updateConnections);
+    }
+
+    // Connection to instance owning pixel (x, y) or gateway. Return null if it is not open yet.
+    connectionFor(x, y) {
+        const conn = (this.gateway !== null) ? this.gateway : this.connections.get(this.ownerOf(x, y));
+        if (conn === undefined || conn.readyState !== WebSocket.OPEN) {
+            return null;
+        }
+        return conn;
+    }
+
+    // Subscribe to canvas events. Resume from given positions (by instance) if there are any.
+    connect(conn, positions) {
+        const resume = Object.keys(positions).length > 0;
         conn.send(
             JSON.stringify({
-                method: "connectMe",
-                sessionToken: this.sessionToken,
+                method: resume ? "resume" : "connectMe",
+                canvas: this.config["CanvasName"],
+                args: {
+                    binary: this.config["BinaryProtocol"],
+                    // Events of each instance come with its snapshot, from its own connection.
+                    ownEventsOnly: true,
+                    positions: positions,
+                },
             })
         );
     }
 
     handleMessage(evt) {
+        if (evt.data instanceof ArrayBuffer) {
+            this.handleBinaryMessage(evt.data);
+            return;
+        }
+
         const message = JSON.parse(evt.data);
+        if (message.canvas !== this.config["CanvasName"]) {
+            // Event from other canvas.
+            return;
+        }
         switch (message.kind) {
-        case "pixelColor":
-            this.handlePixelColorMessage(message.data);
+        case "pixelBatch":
+            this.handlePixelBatchMessage(message.data);
             break;
         case "allPixelsColors":
             this.handleAllPixelsColorsMessage(message.data);
             break;
+        case "resumed":
+            this.handleResumedMessage(message.data);
+            break;
         case "cooldownInfo":
             this.handleCooldownInfoMessage(message.data);
             break;
+        case "pixelInfo":
+            this.handlePixelInfoMessage(message.data);
+            break;
+        case "shardMap":
+            this.handleShardMapMessage(message.data);
+            break;
+
+        default:
+            alert("FAIL (fixme)");
+        }
+    }
+
+    // Decode binary protocol message (see ws_server/protocol.go).
+    handleBinaryMessage(buffer) {
+        const view = new DataView(buffer);
+        if (view.getUint8(1) !== this.config["CanvasIndex"]) {
+            // Event from other canvas.
+            return;
+        }
+
+        // Versions are uint64, but they fit into Number.
+        const readVersion = (offset) => (
+            view.getUint32(offset) * 4294967296 + view.getUint32(offset + 4));
+
+        switch (view.getUint8(0)) {
+        case BINARY_KIND_SNAPSHOT: {
+            const bitsPerPixel = view.getUint8(2);
+            const packed = new Uint8Array(buffer, 28);
+            let colorCodes = packed;
+            if (bitsPerPixel === 4) {
+                colorCodes = new Uint8Array(packed.length * 2);
+                for (let i = 0; i < packed.length; ++i) {
+                    colorCodes[2 * i] = packed[i] >> 4;
+                    colorCodes[2 * i + 1] = packed[i] & 0x0f;
+                }
+            }
+            this.handleAllPixelsColorsMessage({
+                colorCodes: colorCodes,
+                instance: view.getUint32(4),
+                chunkSize: view.getUint32(8),
+                version: readVersion(12),
+                epoch: readVersion(20),
+            });
+            break;
+        }
+        case BINARY_KIND_PIXEL_BATCH: {
+            const count = view.getUint32(4);
+            const pixels = [];
+            for (let i = 0; i < count; ++i) {
+                const offset = 8 + i * 13;
+                pixels.push({
+                    x: view.getUint16(offset),
+                    y: view.getUint16(offset + 2),
+                    color: view.getUint8(offset + 4),
+                    version: readVersion(offset + 5),
+                });
+            }
+            this.handlePixelBatchMessage({instance: view.getUint16(2), pixels: pixels});
+            break;
+        }
 
         default:
             alert("FAIL (fixme)");
         }
     }
 
+    // Return canvas coordinates of pixel under mouse pointer.
+    eventToPixelCoords(evt) {
+        const canvas = this.canvasWrapper.canvas;
+        const rect = canvas.getBoundingClientRect();
+        const realX = evt.clientX - rect.left;
+        const realY = evt.clientY - rect.top;
+        return [
+            Math.floor(realX / PIXEL_SIZE),
+            Math.floor(realY / PIXEL_SIZE),
+        ];
+    }
+
     handleCanvasClick(evt) {
         if (this.timerWidget.cooldownExpiry === null) {
-            const canvas = this.canvasWrapper.canvas;
-            const rect = canvas.getBoundingClientRect();
-            const realX = evt.clientX - rect.left;
-            const realY = evt.clientY - rect.top;
-            const x = Math.floor(realX / PIXEL_SIZE);
-            const y = Math.floor(realY / PIXEL_SIZE);
+            const [x, y] = this.eventToPixelCoords(evt);
 
-            const connIndex = x % this.connections.length;
-            const conn = this.connections[connIndex];
+            const conn = this.connectionFor(x, y);
+            if (conn === null) {
+                return;
+            }
 
             conn.send(
                 JSON.stringify({
                     method: "setPixelColor",
-                    sessionToken: this.sessionToken,
-                    args: {
+                    canvas: this.config["CanvasName"],
+                        args: {
                         x: x,
                         y: y,
                         color: this.paletteWidget.selectedColorCode,
@@ -120,10 +404,57 @@ class Controller {
         }
     }
 
+    // Right click asks who placed pixel.
+    handleCanvasContextMenu(evt) {
+        evt.preventDefault();
+
+        const [x, y] = this.eventToPixelCoords(evt);
+
+        const conn = this.connectionFor(x, y);
+        if (conn === null) {
+            return;
+        }
+
+        conn.send(
+            JSON.stringify({
+                method: "getPixelInfo",
+                canvas: this.config["CanvasName"],
+                args: {
+                    x: x,
+                    y: y,
+                },
+            })
+        );
+    }
+
+    // Pixel changes of one instance made during server broadcast tick.
+    handlePixelBatchMessage(data) {
+        for (let pixel of data.pixels) {
+            // Versions are compared with snapshot of instance which made the change.
+            pixel.instance = data.instance;
+            this.handlePixelColorMessage(pixel);
+        }
+    }
+
     handlePixelColorMessage(data) {
+        const instance = data.instance !== undefined ? data.instance : this.ownerOf(data.x, data.y);
+        const state = this.stateOf(instance);
+        if (state.snapshotVersion === null) {
+            // Wait for snapshot.
+            state.pendingPixels.push(data);
+            return;
+        }
+        if (data.version <= state.snapshotVersion) {
+            // Already included into snapshot.
+            return;
+        }
+
         const colorName = this.paletteWidget.colorsList[data.color];
         this.canvasWrapper.setPixelColor(
             data.x, data.y, colorName);
+        if (data.version > state.lastVersion) {
+            state.lastVersion = data.version;
+        }
     }
 
     handleAllPixelsColorsMessage(data) {
@@ -133,26 +464,93 @@ class Controller {
         const totalHeight = this.config["CanvasRows"];
 
         const matrix = data["colorCodes"];
-        const offset = data["offset"];
-        const eachNth = data["eachNth"];
-
-        const instanceWidth = Math.ceil(totalWidth / eachNth);
-
-        for (let y = 0; y < totalHeight; ++y) {
-            for (let instanceX = 0; instanceX < instanceWidth; ++instanceX) {
-                const x = instanceX * eachNth + offset;
-                if (x < totalWidth) {
-                    const colorCode = matrix[y * instanceWidth + instanceX];
-                    const colorName = colorsTable[colorCode];
-                    this.canvasWrapper.setPixelColor(x, y, colorName);
+        const instance = data["instance"];
+        const chunkSize = data["chunkSize"];
+        const chunksX = this.config["ChunksX"];
+
+        // Snapshot is a sequence of instance chunks, each one is chunkSize * chunkSize
+        // color codes row by row (see common.InstanceLayout).
+        let slot = 0;
+        this.config["ChunkOwners"].forEach((owner, chunk) => {
+            if (owner !== instance) {
+                return;
+            }
+            const chunkLeft = (chunk % chunksX) * chunkSize;
+            const chunkTop = Math.floor(chunk / chunksX) * chunkSize;
+            const slotOffset = slot * chunkSize * chunkSize;
+            for (let localY = 0; localY < chunkSize; ++localY) {
+                for (let localX = 0; localX < chunkSize; ++localX) {
+                    const x = chunkLeft + localX;
+                    const y = chunkTop + localY;
+                    if (x < totalWidth && y < totalHeight) {
+                        const colorCode = matrix[slotOffset + localY * chunkSize + localX];
+                        const colorName = colorsTable[colorCode];
+                        this.canvasWrapper.setPixelColor(x, y, colorName);
+                    }
                 }
             }
+            ++slot;
+        });
+
+        this.handleSnapshotReady(instance, data["epoch"], data["version"]);
+    }
+
+    // Changes missed while connection was lost. Result is the same as snapshot with given version.
+    handleResumedMessage(data) {
+        const colorsTable = this.paletteWidget.colorsList;
+        for (let pixel of data["pixels"]) {
+            this.canvasWrapper.setPixelColor(pixel.x, pixel.y, colorsTable[pixel.color]);
+        }
+        this.handleSnapshotReady(data["instance"], data["epoch"], data["version"]);
+    }
+
+    // Canvas part of instance is up to date with its matrix version. Apply events which came earlier.
+    handleSnapshotReady(instance, epoch, version) {
+        const state = this.stateOf(instance);
+        state.snapshotVersion = version;
+        state.epoch = epoch;
+        state.lastVersion = version;
+        const pendingPixels = state.pendingPixels;
+        state.pendingPixels = [];
+        for (let pixel of pendingPixels) {
+            this.handlePixelColorMessage(pixel);
         }
     }
 
     handleCooldownInfoMessage(data) {
         this.timerWidget.countDown(data);
     }
+
+    handlePixelInfoMessage(data) {
+        this.pixelInfoWidget.show(data);
+    }
+
+    // Canvas was resharded. Take new layout and reconnect, snapshots of old layout are useless.
+    handleShardMapMessage(data) {
+        if (data.version <= this.config["ShardMapVersion"]) {
+            return;
+        }
+        this.config["ShardMapVersion"] = data.version;
+        this.config["ChunkSize"] = data.chunkSize;
+        this.config["ChunksX"] = data.chunksX;
+        this.config["ChunkOwners"] = data.chunkOwners;
+        if (data.addresses) {
+            this.config["WebSocketAppAddresses"] = data.addresses;
+        }
+        this.states.clear();
+
+        if (this.gateway !== null) {
+            this.gateway.close();
+            const allInstances = new Set(data.chunkOwners);
+            this.gateway = this.openConnection(this.config["GatewayAddress"], allInstances);
+        } else {
+            for (let conn of this.connections.values()) {
+                conn.close();
+            }
+            this.connections.clear();
+            this.updateConnections();
+        }
+    }
 }
 
 
@@ -241,3 +639,23 @@ class TimerWidget {
         }, 100);
     }
 }
+
+
+class PixelInfoWidget {
+    constructor(domElement) {
+        this.show = this.show.bind(this);
+
+        this.domElement = domElement;
+    }
+
+    show(pixelInfo) {
+        let text = "(" + pixelInfo.x + ", " + pixelInfo.y + "): ";
+        if (pixelInfo.login) {
+            const placedAt = new Date(pixelInfo.time);
+            text += pixelInfo.login + ", " + placedAt.toLocaleString();
+        } else {
+            text += "nobody yet";
+        }
+        this.domElement.textContent = text;
+    }
+}
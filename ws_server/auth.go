@@ -0,0 +1,69 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/go-redis/redis"
+	"github.com/gorilla/websocket"
+	"github.com/pbsphp/ShittyPixels/common"
+	"net/http"
+)
+
+// Resolve user of websocket connection from handshake request. Return nil if user is not logged in.
+// User is identified by ticket offered as subprotocol (see common.TicketSubprotocols) or by session cookie
+// (works if main server and ws_server share domain).
+func authenticate(rdb *redis.Client, appConfig *common.AppConfig, r *http.Request) (*common.WebSocketIdentity, error) {
+	if ticket := common.TicketFromSubprotocols(websocket.Subprotocols(r)); ticket != "" {
+		identity, err := common.VerifyWebSocketTicket(appConfig, ticket)
+		if err == common.ErrBadTicket {
+			return nil, nil
+		}
+		return identity, err
+	}
+
+	sessionId := common.RequestSessionId(appConfig, r)
+	if sessionId == "" {
+		return nil, nil
+	}
+	session, err := common.GetSessionBySessionId(rdb, sessionId)
+	if err != nil || session == nil || session.Login == "" {
+		return nil, err
+	}
+	return &common.WebSocketIdentity{Login: session.Login, SessionKey: common.SessionKey(session.Id)}, nil
+}
+
+// Authenticate handshake request. Respond with error and return nil if user is not logged in.
+func mustAuthenticate(
+	rdb *redis.Client,
+	appConfig *common.AppConfig,
+	w http.ResponseWriter,
+	r *http.Request,
+) *common.WebSocketIdentity {
+	identity, err := authenticate(rdb, appConfig, r)
+	if err != nil {
+		logError("authenticate", err)
+		http.Error(w, "cannot authenticate", http.StatusInternalServerError)
+		return nil
+	}
+	if identity == nil {
+		http.Error(w, "log in first", http.StatusUnauthorized)
+		return nil
+	}
+	return identity
+}
@@ -0,0 +1,167 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"github.com/go-redis/redis"
+	"github.com/pbsphp/ShittyPixels/common"
+	"log"
+	"sync"
+)
+
+// One canvas (room) served by this instance.
+type Canvas struct {
+	// Index in AppConfig.Canvases. Identifies canvas in binary protocol.
+	index        int
+	config       *common.CanvasConfig
+	matrix       *Matrix
+	checkpointer *Checkpointer
+
+	instanceNumber int
+	// Number of shards for new shard map if canvas has none yet.
+	shardCount int
+
+	// Serializes logging and applying of placements, so checkpoint never misses logged placement.
+	// Also held while matrix is switched to new shard map.
+	placementMu sync.Mutex
+}
+
+// Allocate canvas matrix for shard map and fill it from latest checkpoint and placement log.
+// Return false if there is no checkpoint for this layout.
+func loadMatrix(
+	rdb *redis.Client,
+	canvasConfig *common.CanvasConfig,
+	shardMap *common.ShardMap,
+	instanceNumber int,
+	historyLength int,
+) (*Matrix, bool, error) {
+	// Allocate canvas matrix. Items are colors.
+	matrix := NewMatrix(shardMap, instanceNumber, historyLength)
+
+	restored, err := RestoreCheckpoint(rdb, canvasConfig.Name, &matrix)
+	if err != nil {
+		return nil, false, err
+	}
+	if restored {
+		// Catch up with placements made after checkpoint.
+		replayed, err := ReplayPlacements(rdb, canvasConfig, &matrix)
+		if err != nil {
+			return nil, false, err
+		}
+		log.Printf("canvas %s: %d placements replayed\n", canvasConfig.Name, replayed)
+	}
+	return &matrix, restored, nil
+}
+
+// Allocate canvas matrix and fill it from latest checkpoint and placement log.
+// Draw initial image if there is nothing to restore. Panic on failure.
+func MustLoadCanvas(
+	rdb *redis.Client,
+	index int,
+	appConfig *common.AppConfig,
+	instanceNumber int,
+) *Canvas {
+	canvasConfig := &appConfig.Canvases[index]
+
+	shardMap, err := common.GetShardMap(rdb, canvasConfig, appConfig.ShardCount)
+	if err != nil {
+		log.Panic("cannot read shard map: ", err)
+	}
+
+	matrix, restored, err := loadMatrix(rdb, canvasConfig, shardMap, instanceNumber, appConfig.ResumeHistoryLength)
+	if err != nil {
+		log.Panic("cannot restore canvas: ", err)
+	}
+	if restored {
+		log.Printf("canvas %s restored from checkpoint\n", canvasConfig.Name)
+	} else {
+		MustDrawInitialImage(canvasConfig.InitialImage, matrix, canvasConfig.PaletteColors)
+		// Placements could be logged before checkpoint was ever saved.
+		if _, err := ReplayPlacements(rdb, canvasConfig, matrix); err != nil {
+			log.Panic("cannot replay placements: ", err)
+		}
+	}
+
+	return &Canvas{
+		index:          index,
+		config:         canvasConfig,
+		matrix:         matrix,
+		checkpointer:   NewCheckpointer(rdb, canvasConfig.Name, matrix, appConfig),
+		instanceNumber: instanceNumber,
+		shardCount:     appConfig.ShardCount,
+	}
+}
+
+// Switch canvas to newer shard map if resharding has finished. Return new shard map or nil if it has not changed.
+func (c *Canvas) Reload(rdb *redis.Client) (*common.ShardMap, error) {
+	shardMap, err := common.GetShardMap(rdb, c.config, c.shardCount)
+	if err != nil {
+		return nil, err
+	}
+	if shardMap.Frozen || shardMap.Version <= c.matrix.MapVersion() {
+		return nil, nil
+	}
+
+	c.placementMu.Lock()
+	defer c.placementMu.Unlock()
+
+	// Only data is taken from new matrix, history is not needed.
+	matrix, restored, err := loadMatrix(rdb, c.config, shardMap, c.instanceNumber, 1)
+	if err != nil {
+		return nil, err
+	}
+	if !restored && len(matrix.Data) > 0 {
+		return nil, errors.New("no checkpoint for new shard map")
+	}
+	c.matrix.Replace(matrix)
+
+	log.Printf("canvas %s switched to shard map %d\n", c.config.Name, shardMap.Version)
+	return shardMap, nil
+}
+
+// Reload canvas from checkpoint if placements it has not applied yet were trimmed from log
+// (see Checkpointer.Save). Replica falling behind primary needs it.
+func (c *Canvas) CatchUpWithCheckpoint(rdb *redis.Client) error {
+	lastId := c.matrix.LastPlacementId()
+	firstId, err := common.FirstPlacementId(rdb, c.config.Name, c.instanceNumber)
+	if err != nil || !common.PlacementIdLess(lastId, firstId) {
+		return err
+	}
+	snapshot, err := common.GetCanvasSnapshot(rdb, c.config.Name, c.instanceNumber)
+	if err != nil || snapshot == nil || !common.PlacementIdLess(lastId, snapshot.LastPlacementId) {
+		return err
+	}
+	shardMap, err := common.GetShardMap(rdb, c.config, c.shardCount)
+	if err != nil {
+		return err
+	}
+
+	c.placementMu.Lock()
+	defer c.placementMu.Unlock()
+
+	matrix, restored, err := loadMatrix(rdb, c.config, shardMap, c.instanceNumber, 1)
+	if err != nil || !restored {
+		return err
+	}
+	c.matrix.Replace(matrix)
+
+	log.Printf("canvas %s reloaded from checkpoint, placements were trimmed from log\n", c.config.Name)
+	return nil
+}
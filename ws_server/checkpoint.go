@@ -0,0 +1,178 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/go-redis/redis"
+	"github.com/pbsphp/ShittyPixels/common"
+	"sync/atomic"
+	"time"
+)
+
+// Periodically saves matrix to redis, so canvas survives ws_server restarts.
+type Checkpointer struct {
+	rdb *redis.Client
+	// Canvas name (see CanvasConfig).
+	canvas string
+	matrix *Matrix
+
+	interval        time.Duration
+	everyPlacements int64
+	// Trim placement log after checkpoint (see AppConfig.TrimPlacementLog).
+	trimLog bool
+
+	// Number of placements since last checkpoint.
+	placements int64
+	// Wakes up Run() when there are enough placements.
+	wakeUp chan struct{}
+}
+
+func NewCheckpointer(rdb *redis.Client, canvas string, matrix *Matrix, appConfig *common.AppConfig) *Checkpointer {
+	return &Checkpointer{
+		rdb:             rdb,
+		canvas:          canvas,
+		matrix:          matrix,
+		interval:        time.Duration(appConfig.CheckpointIntervalSeconds) * time.Second,
+		everyPlacements: int64(appConfig.CheckpointEveryPlacements),
+		trimLog:         appConfig.TrimPlacementLog,
+		wakeUp:          make(chan struct{}, 1),
+	}
+}
+
+// Tell checkpointer that pixel was changed.
+func (c *Checkpointer) NotifyPlacement() {
+	placements := atomic.AddInt64(&c.placements, 1)
+	if c.everyPlacements > 0 && placements >= c.everyPlacements {
+		select {
+		case c.wakeUp <- struct{}{}:
+		default:
+			// Already woken up.
+		}
+	}
+}
+
+// Save matrix to redis and drop placements it includes from log if trimming is enabled.
+// Return common.ErrShardMapChanged if matrix is made for outdated shard map.
+func (c *Checkpointer) Save() error {
+	atomic.StoreInt64(&c.placements, 0)
+
+	snapshot := c.matrix.Snapshot()
+	colorCodes := make([]byte, len(snapshot.Data))
+	for i, color := range snapshot.Data {
+		colorCodes[i] = byte(color)
+	}
+
+	err := common.StoreCanvasSnapshot(c.rdb, &common.CanvasSnapshot{
+		Canvas:         c.canvas,
+		ColorCodes:     colorCodes,
+		Layout:         *snapshot.Layout.CanvasLayout,
+		InstanceNumber: snapshot.Layout.Instance,
+		MapVersion:     snapshot.MapVersion,
+
+		LastPlacementId: snapshot.LastPlacementId,
+		CreatedAt:       time.Now().Unix(),
+	})
+	if err != nil || !c.trimLog {
+		return err
+	}
+	// Log is trimmed only up to stored checkpoint, so restoring never misses placements.
+	return common.TrimPlacements(c.rdb, c.canvas, snapshot.Layout.Instance, snapshot.LastPlacementId)
+}
+
+// Save matrix on schedule and after every `everyPlacements' placements. Never returns.
+func (c *Checkpointer) Run() {
+	interval := c.interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.wakeUp:
+		}
+
+		if atomic.LoadInt64(&c.placements) == 0 {
+			// Nothing changed.
+			continue
+		}
+		if err := c.Save(); err == common.ErrShardMapChanged {
+			// Resharding is in progress. New owner gets checkpoint from resharding.
+			continue
+		} else if err != nil {
+			logError("save checkpoint", err)
+		}
+	}
+}
+
+// Load latest checkpoint into matrix.
+// Return false if there is no checkpoint or it was made for other canvas layout.
+func RestoreCheckpoint(rdb *redis.Client, canvas string, matrix *Matrix) (bool, error) {
+	layout := matrix.Layout()
+	snapshot, err := common.GetCanvasSnapshot(rdb, canvas, layout.Instance)
+	if err != nil {
+		return false, err
+	}
+	if snapshot == nil ||
+		!snapshot.Layout.Equal(layout.CanvasLayout) ||
+		snapshot.InstanceNumber != layout.Instance {
+		return false, nil
+	}
+
+	data := make([]Color, len(snapshot.ColorCodes))
+	for i, code := range snapshot.ColorCodes {
+		data[i] = Color(code)
+	}
+	return matrix.Restore(data, snapshot.LastPlacementId), nil
+}
+
+// Apply placements logged after latest applied one. Return number of applied placements.
+func ReplayPlacements(rdb *redis.Client, canvasConfig *common.CanvasConfig, matrix *Matrix) (int, error) {
+	replayed := 0
+	err := common.ForEachPlacement(
+		rdb,
+		canvasConfig.Name,
+		matrix.Layout().Instance,
+		matrix.LastPlacementId(),
+		func(event *common.PlacementEvent) error {
+			if int(event.Color) >= len(canvasConfig.PaletteColors) {
+				// Log entry with color outside of palette (palette was changed or log was tampered).
+				matrix.SkipPlacement(event.Id)
+				return nil
+			}
+			// Placements made with other canvas layout may belong to other instance now.
+			if _, ok := matrix.Apply(event.X, event.Y, Color(event.Color), event.Id); ok {
+				replayed++
+			}
+			return nil
+		},
+	)
+	return replayed, err
+}
+
+// Save checkpoints of all canvases, log failures.
+func saveCheckpoints(canvases map[string]*Canvas) {
+	for _, canvas := range canvases {
+		if err := canvas.checkpointer.Save(); err != nil {
+			logError("save checkpoint", err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/pbsphp/ShittyPixels/common"
+	"testing"
+)
+
+func TestCheckpointerNotifyPlacement(t *testing.T) {
+	c := NewCheckpointer(nil, "main", nil, &common.AppConfig{CheckpointEveryPlacements: 3})
+	woken := func() bool {
+		select {
+		case <-c.wakeUp:
+			return true
+		default:
+			return false
+		}
+	}
+
+	c.NotifyPlacement()
+	c.NotifyPlacement()
+	if woken() {
+		t.Fatal("checkpointer is woken up before CheckpointEveryPlacements placements")
+	}
+	// Placements after threshold do not block while checkpointer is busy.
+	for i := 0; i < 10; i++ {
+		c.NotifyPlacement()
+	}
+	if !woken() {
+		t.Fatal("checkpointer is not woken up")
+	}
+	if woken() {
+		t.Error("checkpointer is woken up twice")
+	}
+
+	// Without CheckpointEveryPlacements checkpoints are made only on schedule.
+	c = NewCheckpointer(nil, "main", nil, &common.AppConfig{})
+	for i := 0; i < 10; i++ {
+		c.NotifyPlacement()
+	}
+	if woken() {
+		t.Error("checkpointer is woken up without CheckpointEveryPlacements")
+	}
+}
+
+func TestMatrixRestore(t *testing.T) {
+	shardMap := &common.ShardMap{
+		Version: 1,
+		Layout:  common.MustNewCanvasLayout(&common.CanvasConfig{CanvasCols: 8, CanvasRows: 4, ChunkSize: 4}, 2),
+	}
+	matrix := NewMatrix(shardMap, 1, 2)
+	if matrix.Restore(make([]Color, len(matrix.Data)+1), "1-0") {
+		t.Fatal("data of other size is restored")
+	}
+
+	data := make([]Color, len(matrix.Data))
+	for i := range data {
+		data[i] = Color(i % 16)
+	}
+	if !matrix.Restore(data, "5-1") {
+		t.Fatal("data is not restored")
+	}
+	// Instance 1 has the second chunk: (4, 0) is its first pixel.
+	if color, ok := matrix.Get(5, 1); !ok || color != data[1*4+1] {
+		t.Errorf("(5, 1) is %d, %v, want %d", color, ok, data[1*4+1])
+	}
+	if id := matrix.LastPlacementId(); id != "5-1" {
+		t.Errorf("last placement id is %q, want 5-1", id)
+	}
+
+	// Placement without id keeps the last one, skipped placement moves it on.
+	matrix.Apply(6, 2, 1, "6-0")
+	matrix.Apply(7, 3, 2, "")
+	if id := matrix.LastPlacementId(); id != "6-0" {
+		t.Errorf("last placement id is %q after placement without id, want 6-0", id)
+	}
+	matrix.SkipPlacement("7-0")
+	if id := matrix.LastPlacementId(); id != "7-0" {
+		t.Errorf("last placement id is %q after skipped placement, want 7-0", id)
+	}
+	if color, _ := matrix.Get(6, 2); color != 1 {
+		t.Errorf("(6, 2) is %d after placement, want 1", color)
+	}
+}
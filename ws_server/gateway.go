@@ -0,0 +1,391 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/websocket"
+	"github.com/pbsphp/ShittyPixels/common"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Gateway mode. Browser opens one websocket to gateway, gateway opens websockets to instances
+// on behalf of browser and forwards requests to instance owning the pixel:
+// connectMe and resume go to all instances, setPixelColor and getPixelInfo go to owner of (x, y).
+// Everything instances send (pixelBatch events, allPixelsColors snapshots, replies) is forwarded
+// to browser as is, so browser gets one merged stream. Snapshots tell instance they came from.
+// After resharding instances send shardMap message and browser reconnects.
+type GatewayHandler struct {
+	rdb            *redis.Client
+	appConfig      *common.AppConfig
+	upgraderConfig websocket.Upgrader
+	dialer         *websocket.Dialer
+
+	// Guards layouts.
+	mu sync.RWMutex
+	// Canvas layouts from current shard maps by canvas name.
+	layouts map[string]*common.CanvasLayout
+}
+
+// Instance which does not accept connection in time is treated as lost. Requests of browser
+// are forwarded one by one, so slow dial delays all of them.
+const gatewayDialTimeout = 5 * time.Second
+
+// Create gateway handler and start following shard maps. Panic if shard maps can not be read.
+func NewGatewayHandler(rdb *redis.Client, appConfig *common.AppConfig, upgraderConfig websocket.Upgrader) *GatewayHandler {
+	h := &GatewayHandler{
+		rdb:            rdb,
+		appConfig:      appConfig,
+		upgraderConfig: upgraderConfig,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: gatewayDialTimeout,
+		},
+	}
+	if err := h.loadLayouts(); err != nil {
+		panic(err)
+	}
+	go h.watchShardMaps()
+	return h
+}
+
+func (h *GatewayHandler) loadLayouts() error {
+	layouts := make(map[string]*common.CanvasLayout)
+	for i := range h.appConfig.Canvases {
+		canvasConfig := &h.appConfig.Canvases[i]
+		shardMap, err := common.GetShardMap(h.rdb, canvasConfig, h.appConfig.ShardCount)
+		if err != nil {
+			return err
+		}
+		layouts[canvasConfig.Name] = shardMap.Layout
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.layouts = layouts
+	return nil
+}
+
+// Reload layouts after resharding. Never returns.
+func (h *GatewayHandler) watchShardMaps() {
+	pubsub := h.rdb.Subscribe(common.ShardMapUpdatesChannel)
+	defer pubsub.Close()
+	updates := pubsub.Channel()
+
+	// Notification may be lost while redis connection is broken, so reload from time to time.
+	ticker := time.NewTicker(common.ShardLeaseTTL(h.appConfig))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-updates:
+		case <-ticker.C:
+		}
+		if err := h.loadLayouts(); err != nil {
+			logError("load shard maps", err)
+		}
+	}
+}
+
+// Does request subscribe client to canvas.
+func isConnectRequest(wsMessage *WebSocketRequestData) bool {
+	return wsMessage.Method == "connectMe" || wsMessage.Method == "resume"
+}
+
+// Instances which should get request.
+func (h *GatewayHandler) route(wsMessage *WebSocketRequestData) []int {
+	h.mu.RLock()
+	layout, ok := h.layouts[wsMessage.Canvas]
+	h.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	if isConnectRequest(wsMessage) {
+		instances := make([]int, layout.Shards)
+		for i := range instances {
+			instances[i] = i
+		}
+		return instances
+	}
+
+	x, y, err := argsToCoords(wsMessage.Args)
+	if err != nil {
+		return nil
+	}
+	owner := layout.Owner(x, y)
+	if owner < 0 {
+		return nil
+	}
+	return []int{owner}
+}
+
+// Connection to instance holding shard, opened on behalf of browser.
+// If instance is lost, it reconnects to new primary of the shard (see RunReplica) and repeats connectMe (and resume) requests,
+// so browser gets fresh snapshot of the shard.
+type gatewayUpstream struct {
+	h        *GatewayHandler
+	instance int
+	// Origin of browser request, forwarded to instance.
+	header http.Header
+	// User of browser connection. Gateway issues new ticket on every dial, so reconnects do not depend
+	// on lifetime of ticket browser has come with.
+	identity *common.WebSocketIdentity
+	client   *Client
+
+	// Guards conn, connectRequests and closed. Held while writing to conn, but not while dialing.
+	mu   sync.Mutex
+	conn *websocket.Conn
+	// Latest connectMe and latest resume request of each canvas sent to instance, oldest first.
+	connectRequests []connectRequest
+	closed          bool
+}
+
+// Request repeated to instance after reconnect.
+type connectRequest struct {
+	canvas  string
+	method  string
+	message []byte
+}
+
+func (h *GatewayHandler) newUpstream(
+	instance int,
+	r *http.Request,
+	identity *common.WebSocketIdentity,
+	c *Client,
+) *gatewayUpstream {
+	header := http.Header{}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		header.Set("Origin", origin)
+	}
+	return &gatewayUpstream{h: h, instance: instance, header: header, identity: identity, client: c}
+}
+
+func (u *gatewayUpstream) dial() (*websocket.Conn, error) {
+	address, err := common.GetShardAddress(u.h.rdb, u.instance)
+	if err != nil {
+		return nil, err
+	}
+	if address == "" {
+		return nil, errors.New("shard is not served")
+	}
+	ticket, err := common.IssueWebSocketTicket(u.h.appConfig, u.identity.Login, u.identity.SessionKey)
+	if err != nil {
+		return nil, err
+	}
+	header := u.header.Clone()
+	header.Set("Sec-WebSocket-Protocol", strings.Join(common.TicketSubprotocols(ticket), ", "))
+	conn, _, err := u.h.dialer.Dial(address, header)
+	if err != nil {
+		return nil, err
+	}
+
+	// Instance pings gateway (see Client.writePump). Instance is lost if pings stop coming.
+	_, maxIdle := keepaliveSettings(u.h.appConfig)
+	_ = conn.SetReadDeadline(time.Now().Add(maxIdle))
+	conn.SetPingHandler(func(data string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(maxIdle))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+	return conn, nil
+}
+
+// Remember connect request, replacing older one of the same canvas and method. Should be called with mu held.
+func (u *gatewayUpstream) rememberConnectRequest(wsMessage *WebSocketRequestData, message []byte) {
+	requests := u.connectRequests[:0]
+	for _, request := range u.connectRequests {
+		if request.canvas != wsMessage.Canvas || request.method != wsMessage.Method {
+			requests = append(requests, request)
+		}
+	}
+	u.connectRequests = append(requests, connectRequest{
+		canvas:  wsMessage.Canvas,
+		method:  wsMessage.Method,
+		message: message,
+	})
+}
+
+// Forward request to instance. Connect to it first if needed.
+func (u *gatewayUpstream) Send(mt int, message []byte, wsMessage *WebSocketRequestData) error {
+	u.mu.Lock()
+	if u.conn == nil && !u.closed {
+		// Dial without lock, so slow instance does not block Close and reconnect of readPump.
+		u.mu.Unlock()
+		conn, err := u.dial()
+		if err != nil {
+			return err
+		}
+		u.mu.Lock()
+		if u.conn == nil && !u.closed {
+			u.conn = conn
+			go u.readPump(conn)
+		} else {
+			_ = conn.Close()
+		}
+	}
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return errors.New("upstream is closed")
+	}
+	if isConnectRequest(wsMessage) {
+		u.rememberConnectRequest(wsMessage, message)
+	}
+	return u.conn.WriteMessage(mt, message)
+}
+
+// Forward everything instance sends to client. Reconnect if instance is lost.
+func (u *gatewayUpstream) readPump(conn *websocket.Conn) {
+	for {
+		mt, message, err := conn.ReadMessage()
+		if err != nil {
+			if !isWsClosedOk(err) {
+				logError("read upstream", err)
+			}
+			conn = u.reconnect(conn)
+			if conn == nil {
+				return
+			}
+			continue
+		}
+		msg, err := websocket.NewPreparedMessage(mt, message)
+		if err != nil {
+			logError("prepare upstream message", err)
+			continue
+		}
+		if !u.client.Send(msg) {
+			return
+		}
+	}
+}
+
+// Wait for new primary of the shard (until lease of the lost one expires and replica takes over).
+// Return nil if upstream is closed or shard is not served for too long. Browser has to reconnect then.
+func (u *gatewayUpstream) reconnect(lost *websocket.Conn) *websocket.Conn {
+	_ = lost.Close()
+	deadline := time.Now().Add(2 * common.ShardLeaseTTL(u.h.appConfig))
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+
+		u.mu.Lock()
+		closed := u.closed
+		u.mu.Unlock()
+		if closed {
+			return nil
+		}
+
+		conn, err := u.dial()
+		if err != nil {
+			continue
+		}
+		u.mu.Lock()
+		if u.closed {
+			u.mu.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		for _, request := range u.connectRequests {
+			if err = conn.WriteMessage(websocket.TextMessage, request.message); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			u.mu.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		u.conn = conn
+		u.mu.Unlock()
+		return conn
+	}
+
+	u.client.Close()
+	return nil
+}
+
+func (u *gatewayUpstream) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+	if u.conn != nil {
+		_ = u.conn.Close()
+	}
+}
+
+func (h *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	identity := mustAuthenticate(h.rdb, h.appConfig, w, r)
+	if identity == nil {
+		return
+	}
+
+	conn, err := NewWebSocketConnectionWrapper(&h.upgraderConfig, w, r)
+	if err != nil {
+		logError("upgrade", err)
+		return
+	}
+	// Client writer goroutine closes connection when client is closed.
+	c := NewClient(conn, h.appConfig)
+	defer c.Close()
+
+	// Connections to instances, opened on first request.
+	upstreams := make(map[int]*gatewayUpstream)
+	defer func() {
+		for _, upstream := range upstreams {
+			upstream.Close()
+		}
+	}()
+
+	for {
+		mt, message, err := conn.ReadRawMessage()
+		if err != nil {
+			if !isWsClosedOk(err) {
+				logError("read websocket request", err)
+			}
+			return
+		}
+
+		wsMessage := WebSocketRequestData{}
+		if err := json.Unmarshal(message, &wsMessage); err != nil {
+			logError("unmarshal request", err)
+			continue
+		}
+
+		for _, instance := range h.route(&wsMessage) {
+			upstream, ok := upstreams[instance]
+			if !ok {
+				upstream = h.newUpstream(instance, r, identity, c)
+				upstreams[instance] = upstream
+			}
+			if err := upstream.Send(mt, message, &wsMessage); err != nil {
+				// Shard may be between instances now. Serve others, retry on next request.
+				logError("write upstream", err)
+			}
+		}
+	}
+}
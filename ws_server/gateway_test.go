@@ -0,0 +1,78 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/pbsphp/ShittyPixels/common"
+	"reflect"
+	"testing"
+)
+
+func TestGatewayRoute(t *testing.T) {
+	// Chunks (3x2): 0 1 2 / 0 1 2.
+	layout := common.MustNewCanvasLayout(&common.CanvasConfig{CanvasCols: 12, CanvasRows: 8, ChunkSize: 4}, 3)
+	h := &GatewayHandler{layouts: map[string]*common.CanvasLayout{"main": layout}}
+
+	coords := func(x, y float64) map[string]interface{} {
+		return map[string]interface{}{"x": x, "y": y}
+	}
+	cases := []struct {
+		name    string
+		message WebSocketRequestData
+		want    []int
+	}{
+		{"connectMe", WebSocketRequestData{Method: "connectMe", Canvas: "main"}, []int{0, 1, 2}},
+		{"resume", WebSocketRequestData{Method: "resume", Canvas: "main"}, []int{0, 1, 2}},
+		{"first chunk", WebSocketRequestData{Method: "setPixelColor", Canvas: "main", Args: coords(0, 0)}, []int{0}},
+		{"second chunk", WebSocketRequestData{Method: "setPixelColor", Canvas: "main", Args: coords(5, 7)}, []int{1}},
+		{"last pixel", WebSocketRequestData{Method: "setPixelColor", Canvas: "main", Args: coords(11, 7)}, []int{2}},
+		{"outside", WebSocketRequestData{Method: "setPixelColor", Canvas: "main", Args: coords(12, 0)}, nil},
+		{"negative", WebSocketRequestData{Method: "setPixelColor", Canvas: "main", Args: coords(-1, 0)}, nil},
+		{"no coordinates", WebSocketRequestData{Method: "setPixelColor", Canvas: "main"}, nil},
+		{"unknown canvas", WebSocketRequestData{Method: "connectMe", Canvas: "other"}, nil},
+	}
+	for _, c := range cases {
+		if got := h.route(&c.message); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: instances are %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRememberConnectRequest(t *testing.T) {
+	u := &gatewayUpstream{}
+	requests := []WebSocketRequestData{
+		{Method: "connectMe", Canvas: "main"},
+		{Method: "connectMe", Canvas: "sandbox"},
+		{Method: "resume", Canvas: "main"},
+		{Method: "resume", Canvas: "main"},
+	}
+	for i := range requests {
+		u.rememberConnectRequest(&requests[i], []byte{byte(i)})
+	}
+
+	// Latest request of each canvas and method, in order of sending.
+	want := []connectRequest{
+		{canvas: "main", method: "connectMe", message: []byte{0}},
+		{canvas: "sandbox", method: "connectMe", message: []byte{1}},
+		{canvas: "main", method: "resume", message: []byte{3}},
+	}
+	if !reflect.DeepEqual(u.connectRequests, want) {
+		t.Errorf("connect requests are %+v, want %+v", u.connectRequests, want)
+	}
+}
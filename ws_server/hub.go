@@ -0,0 +1,437 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"expvar"
+	"github.com/gorilla/websocket"
+	"github.com/pbsphp/ShittyPixels/common"
+	"image"
+	"net"
+	"sync"
+	"time"
+)
+
+// Default length of client outbound queue.
+const defaultSendQueueLength = 256
+
+// Default time limit for writing one message to client.
+const defaultWriteTimeout = 10 * time.Second
+
+// Default time connection may stay silent (no messages and no pongs) before it is considered dead.
+const defaultMaxIdle = 60 * time.Second
+
+// Counters for tuning SendQueueLength and WriteTimeoutSeconds. Served at /debug/vars.
+var (
+	connectedClients = expvar.NewInt("connectedClients")
+	// Clients whose outbound queue was more than 3/4 full at least once.
+	slowClients = expvar.NewInt("slowClients")
+	// Clients dropped because of outbound queue overflow.
+	evictedClients = expvar.NewInt("evictedClients")
+	// Clients dropped because write took longer than write timeout.
+	writeTimeouts = expvar.NewInt("writeTimeouts")
+	// Clients dropped because they did not answer pings.
+	idleTimeouts = expvar.NewInt("idleTimeouts")
+)
+
+// Interval between pings and max idle time of websocket connections.
+// Pings have to be sent more often than idle timeout, otherwise live connections would be dropped.
+func keepaliveSettings(appConfig *common.AppConfig) (pingInterval, maxIdle time.Duration) {
+	maxIdle = time.Duration(appConfig.MaxIdleSeconds) * time.Second
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdle
+	}
+	pingInterval = time.Duration(appConfig.PingIntervalSeconds) * time.Second
+	if pingInterval <= 0 || pingInterval >= maxIdle {
+		pingInterval = maxIdle / 2
+	}
+	return pingInterval, maxIdle
+}
+
+// Websocket client. Only writer goroutine (see writePump) writes to connection,
+// everyone else puts messages into `send' queue.
+type Client struct {
+	conn         *WebSocketConnectionWrapper
+	send         chan *websocket.PreparedMessage
+	writeTimeout time.Duration
+	pingInterval time.Duration
+	// Closed when client is evicted. Writer drops queued messages and closes connection.
+	evicted chan struct{}
+
+	// Guards `closed', `slow', closing of `send' and `evicted'.
+	mu     sync.Mutex
+	closed bool
+	slow   bool
+}
+
+// Create client and start its writer goroutine.
+// Connection is considered dead if client does not answer pings (see WebSocketConnectionWrapper.SetMaxIdle).
+func NewClient(conn *WebSocketConnectionWrapper, appConfig *common.AppConfig) *Client {
+	queueLength := appConfig.SendQueueLength
+	if queueLength <= 0 {
+		queueLength = defaultSendQueueLength
+	}
+	writeTimeout := time.Duration(appConfig.WriteTimeoutSeconds) * time.Second
+	if writeTimeout <= 0 {
+		writeTimeout = defaultWriteTimeout
+	}
+	pingInterval, maxIdle := keepaliveSettings(appConfig)
+	conn.SetMaxIdle(maxIdle)
+
+	c := &Client{
+		conn:         conn,
+		send:         make(chan *websocket.PreparedMessage, queueLength),
+		writeTimeout: writeTimeout,
+		pingInterval: pingInterval,
+		evicted:      make(chan struct{}),
+	}
+	connectedClients.Add(1)
+	go c.writePump()
+	return c
+}
+
+// Put message into outbound queue without blocking.
+// Return false if client is closed. Client is evicted if queue is full.
+func (c *Client) Send(msg *websocket.PreparedMessage) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- msg:
+		if !c.slow && len(c.send) > cap(c.send)*3/4 {
+			c.slow = true
+			slowClients.Add(1)
+		}
+		return true
+	default:
+		// Client can not keep up, waiting for it would stall everybody else.
+		c.closed = true
+		close(c.evicted)
+		evictedClients.Add(1)
+		return false
+	}
+}
+
+// Close outbound queue. Writer goroutine will close connection. Safe to call several times.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+// Write queued messages and pings to connection until queue is closed or connection fails.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.pingInterval)
+	defer func() {
+		ticker.Stop()
+		if err := c.conn.Close(); err != nil {
+			logError("close connection", err)
+		}
+		connectedClients.Add(-1)
+	}()
+
+	for {
+		select {
+		case <-c.evicted:
+			// Queued messages are dropped, client has to reconnect and get fresh snapshot.
+			_ = c.conn.WriteCloseMessage(websocket.CloseTryAgainLater, "too slow", time.Now().Add(c.writeTimeout))
+			return
+
+		case <-ticker.C:
+			if err := c.conn.WritePing(time.Now().Add(c.writeTimeout)); err != nil {
+				return
+			}
+
+		case msg, ok := <-c.send:
+			if !ok {
+				// Queue is closed, say goodbye.
+				_ = c.conn.WriteCloseMessage(websocket.CloseNormalClosure, "", time.Now().Add(c.writeTimeout))
+				return
+			}
+			if err := c.conn.WritePreparedMessage(msg, time.Now().Add(c.writeTimeout)); err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					writeTimeouts.Add(1)
+				} else if !isWsClosedOk(err) {
+					logError("write response", err)
+				}
+				return
+			}
+		}
+	}
+}
+
+// Default interval between pixelBatch messages.
+const defaultBroadcastTick = 50 * time.Millisecond
+
+type subscription struct {
+	client *Client
+	canvas string
+	binary bool
+	// Do not send events relayed from other instances.
+	ownEventsOnly bool
+}
+
+// Same event in JSON and binary protocols. Each client gets the one it has asked for.
+type broadcastMessage struct {
+	canvas string
+	text   *websocket.PreparedMessage
+	binary *websocket.PreparedMessage
+}
+
+// Pixel changed on canvas.
+type pixelEvent struct {
+	canvas      string
+	canvasIndex int
+	// Shard whose matrix version pixel.Version is.
+	shard int
+	pixel PixelInfo
+	// Event of other instance (see relay.go).
+	relayed bool
+}
+
+// Pixel updates of one canvas shard collected since last tick. Only last update of each pixel is kept.
+type pixelBatch struct {
+	canvasIndex int
+	shard       int
+	pixels      []PixelInfo
+	// Is pixel update relayed from other instance, by position in `pixels'.
+	relayed    []bool
+	hasRelayed bool
+	// Position in `pixels' by pixel coordinates.
+	positions map[image.Point]int
+}
+
+func (b *pixelBatch) add(e *pixelEvent) {
+	point := image.Pt(e.pixel.X, e.pixel.Y)
+	i, ok := b.positions[point]
+	if !ok {
+		i = len(b.pixels)
+		b.positions[point] = i
+		b.pixels = append(b.pixels, PixelInfo{})
+		b.relayed = append(b.relayed, false)
+	}
+	b.pixels[i] = e.pixel
+	b.relayed[i] = e.relayed
+	b.hasRelayed = b.hasRelayed || e.relayed
+}
+
+// Pixel updates made by this instance.
+func (b *pixelBatch) own() []PixelInfo {
+	if !b.hasRelayed {
+		return b.pixels
+	}
+	own := make([]PixelInfo, 0, len(b.pixels))
+	for i := range b.pixels {
+		if !b.relayed[i] {
+			own = append(own, b.pixels[i])
+		}
+	}
+	return own
+}
+
+// Keeps track of clients subscribed to canvases and broadcasts events to them.
+// All maps are owned by Run goroutine, other goroutines talk to hub through channels.
+type Hub struct {
+	register   chan subscription
+	unregister chan *Client
+	broadcast  chan broadcastMessage
+	pixels     chan pixelEvent
+	tick       time.Duration
+
+	// Clients subscribed to canvas by canvas name.
+	subscribers map[string]map[*Client]subscription
+	// Pixel updates waiting for next tick by canvas name and shard.
+	batches map[string]map[int]*pixelBatch
+}
+
+// Create hub sending pixel updates every `tick'.
+func NewHub(tick time.Duration) *Hub {
+	if tick <= 0 {
+		tick = defaultBroadcastTick
+	}
+	return &Hub{
+		register:    make(chan subscription),
+		unregister:  make(chan *Client),
+		broadcast:   make(chan broadcastMessage, defaultSendQueueLength),
+		pixels:      make(chan pixelEvent, defaultSendQueueLength),
+		tick:        tick,
+		subscribers: make(map[string]map[*Client]subscription),
+		batches:     make(map[string]map[int]*pixelBatch),
+	}
+}
+
+// Subscribe client to canvas events. Binary clients get events in binary protocol (see protocol.go).
+// Clients with ownEventsOnly do not get events relayed from other instances.
+func (h *Hub) Register(client *Client, canvas string, binary, ownEventsOnly bool) {
+	h.register <- subscription{client: client, canvas: canvas, binary: binary, ownEventsOnly: ownEventsOnly}
+}
+
+// Unsubscribe client from all canvases and close it.
+func (h *Hub) Unregister(client *Client) {
+	h.unregister <- client
+}
+
+// Send message to all clients subscribed to canvas. Collected pixel updates of canvas are sent before it.
+func (h *Hub) Broadcast(canvas string, text, binary *websocket.PreparedMessage) {
+	h.broadcast <- broadcastMessage{canvas: canvas, text: text, binary: binary}
+}
+
+// Send pixel update of shard to clients subscribed to canvas with next pixelBatch message.
+func (h *Hub) BroadcastPixel(canvas *Canvas, shard int, pixel *PixelInfo) {
+	h.pixels <- pixelEvent{canvas: canvas.config.Name, canvasIndex: canvas.index, shard: shard, pixel: *pixel}
+}
+
+// Send pixel update of other instance to clients subscribed to canvas with next pixelBatch message.
+func (h *Hub) RelayPixel(canvas *Canvas, shard int, pixel *PixelInfo) {
+	h.pixels <- pixelEvent{
+		canvas:      canvas.config.Name,
+		canvasIndex: canvas.index,
+		shard:       shard,
+		pixel:       *pixel,
+		relayed:     true,
+	}
+}
+
+func (h *Hub) removeClient(client *Client) {
+	for _, clients := range h.subscribers {
+		delete(clients, client)
+	}
+	client.Close()
+}
+
+// Send message to clients subscribed to canvas. Clients with ownEventsOnly get `own' message, which may be nil.
+func (h *Hub) send(canvas string, own, all *broadcastMessage) {
+	for client, s := range h.subscribers[canvas] {
+		b := all
+		if s.ownEventsOnly {
+			b = own
+		}
+		if b == nil {
+			continue
+		}
+		msg := b.text
+		if s.binary {
+			msg = b.binary
+		}
+		if !client.Send(msg) {
+			// Client is evicted (or dead).
+			h.removeClient(client)
+		}
+	}
+}
+
+// Make pixelBatch message in both protocols.
+func preparePixelBatch(canvas string, canvasIndex int, shard int, pixels []PixelInfo) (*broadcastMessage, error) {
+	text, err := prepareResponse(websocket.TextMessage, &WebSocketResponseData{
+		Kind:   "pixelBatch",
+		Canvas: canvas,
+		Data: struct {
+			Instance int         `json:"instance"`
+			Pixels   []PixelInfo `json:"pixels"`
+		}{shard, pixels},
+	})
+	if err != nil {
+		return nil, err
+	}
+	binary, err := websocket.NewPreparedMessage(
+		websocket.BinaryMessage, encodeBinaryPixelBatch(canvasIndex, shard, pixels))
+	if err != nil {
+		return nil, err
+	}
+	return &broadcastMessage{canvas: canvas, text: text, binary: binary}, nil
+}
+
+// Send collected pixel updates of canvas, one message per shard. Every message is marshalled once for all clients.
+func (h *Hub) flush(canvas string) {
+	batches, ok := h.batches[canvas]
+	if !ok {
+		return
+	}
+	delete(h.batches, canvas)
+
+	for _, batch := range batches {
+		var own, all *broadcastMessage
+		var err error
+		if ownPixels := batch.own(); len(ownPixels) > 0 {
+			if own, err = preparePixelBatch(canvas, batch.canvasIndex, batch.shard, ownPixels); err != nil {
+				logError("marshal response (broadcast)", err)
+				continue
+			}
+		}
+		all = own
+		if batch.hasRelayed {
+			if all, err = preparePixelBatch(canvas, batch.canvasIndex, batch.shard, batch.pixels); err != nil {
+				logError("marshal response (broadcast)", err)
+				continue
+			}
+		}
+		h.send(canvas, own, all)
+	}
+}
+
+// Serve hub channels. Never returns.
+func (h *Hub) Run() {
+	ticker := time.NewTicker(h.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case s := <-h.register:
+			clients, ok := h.subscribers[s.canvas]
+			if !ok {
+				clients = make(map[*Client]subscription)
+				h.subscribers[s.canvas] = clients
+			}
+			clients[s.client] = s
+
+		case client := <-h.unregister:
+			h.removeClient(client)
+
+		case e := <-h.pixels:
+			batches, ok := h.batches[e.canvas]
+			if !ok {
+				batches = make(map[int]*pixelBatch)
+				h.batches[e.canvas] = batches
+			}
+			batch, ok := batches[e.shard]
+			if !ok {
+				batch = &pixelBatch{canvasIndex: e.canvasIndex, shard: e.shard, positions: make(map[image.Point]int)}
+				batches[e.shard] = batch
+			}
+			batch.add(&e)
+
+		case b := <-h.broadcast:
+			// Keep order of events.
+			h.flush(b.canvas)
+			h.send(b.canvas, &b, &b)
+
+		case <-ticker.C:
+			for canvas := range h.batches {
+				h.flush(canvas)
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/pbsphp/ShittyPixels/common"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Client without connection and writer goroutine, only its queue is used.
+func newQueueClient(queueLength int) *Client {
+	return &Client{
+		send:    make(chan *websocket.PreparedMessage, queueLength),
+		evicted: make(chan struct{}),
+	}
+}
+
+func testMessage(t *testing.T) *websocket.PreparedMessage {
+	msg, err := websocket.NewPreparedMessage(websocket.TextMessage, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestClientSendEvictsOnFullQueue(t *testing.T) {
+	c := newQueueClient(2)
+	msg := testMessage(t)
+	evictedBefore := evictedClients.Value()
+
+	for i := 0; i < 2; i++ {
+		if !c.Send(msg) {
+			t.Fatalf("message %d is not queued", i)
+		}
+	}
+	if c.Send(msg) {
+		t.Fatal("message is queued over queue length")
+	}
+	select {
+	case <-c.evicted:
+	default:
+		t.Fatal("client is not evicted")
+	}
+	if got := evictedClients.Value() - evictedBefore; got != 1 {
+		t.Errorf("evictedClients grew by %d, want 1", got)
+	}
+
+	// Evicted client accepts nothing, closing it is safe.
+	if c.Send(msg) {
+		t.Error("evicted client accepts messages")
+	}
+	c.Close()
+	if got := evictedClients.Value() - evictedBefore; got != 1 {
+		t.Errorf("evictedClients grew by %d after eviction, want 1", got)
+	}
+}
+
+func TestHubSendRemovesEvictedClient(t *testing.T) {
+	h := NewHub(0)
+	fast := newQueueClient(4)
+	slow := newQueueClient(1)
+	h.subscribers["main"] = map[*Client]subscription{
+		fast: {client: fast, canvas: "main"},
+		slow: {client: slow, canvas: "main", binary: true},
+	}
+	msg := testMessage(t)
+	b := &broadcastMessage{canvas: "main", text: msg, binary: msg}
+
+	h.send("main", b, b)
+	if len(h.subscribers["main"]) != 2 {
+		t.Fatalf("%d subscribers after first message, want 2", len(h.subscribers["main"]))
+	}
+	h.send("main", b, b)
+	if _, ok := h.subscribers["main"][slow]; ok {
+		t.Error("slow client is still subscribed")
+	}
+	if _, ok := h.subscribers["main"][fast]; !ok {
+		t.Error("fast client is unsubscribed")
+	}
+	if len(fast.send) != 2 {
+		t.Errorf("fast client got %d messages, want 2", len(fast.send))
+	}
+}
+
+func TestKeepaliveSettings(t *testing.T) {
+	cases := []struct {
+		pingSeconds, idleSeconds int
+		wantPing, wantIdle       time.Duration
+	}{
+		{0, 0, defaultMaxIdle / 2, defaultMaxIdle},
+		{10, 0, 10 * time.Second, defaultMaxIdle},
+		{0, 30, 15 * time.Second, 30 * time.Second},
+		{20, 30, 20 * time.Second, 30 * time.Second},
+		// Pings as rare as idle timeout would drop live connections.
+		{30, 30, 15 * time.Second, 30 * time.Second},
+		{90, 0, defaultMaxIdle / 2, defaultMaxIdle},
+	}
+	for _, c := range cases {
+		ping, idle := keepaliveSettings(&common.AppConfig{PingIntervalSeconds: c.pingSeconds, MaxIdleSeconds: c.idleSeconds})
+		if ping != c.wantPing || idle != c.wantIdle {
+			t.Errorf("ping %d, idle %d: settings are %v, %v, want %v, %v",
+				c.pingSeconds, c.idleSeconds, ping, idle, c.wantPing, c.wantIdle)
+		}
+	}
+}
+
+// Serve one websocket connection with given max idle time. Server pings client every pingInterval
+// (0 for no pings) and sends result of first read to result.
+func serveIdleTest(t *testing.T, maxIdle, pingInterval time.Duration, result chan<- error) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := NewWebSocketConnectionWrapper(&upgrader, w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		conn.SetMaxIdle(maxIdle)
+		done := make(chan struct{})
+		defer close(done)
+		if pingInterval > 0 {
+			go func() {
+				ticker := time.NewTicker(pingInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+						_ = conn.WritePing(time.Now().Add(time.Second))
+					}
+				}
+			}()
+		}
+		_, _, err = conn.ReadRawMessage()
+		result <- err
+	}))
+}
+
+func dialIdleTest(t *testing.T, server *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestSilentConnectionIsDropped(t *testing.T) {
+	result := make(chan error, 1)
+	server := serveIdleTest(t, 100*time.Millisecond, 0, result)
+	defer server.Close()
+	conn := dialIdleTest(t, server)
+	defer conn.Close()
+	timeoutsBefore := idleTimeouts.Value()
+
+	select {
+	case err := <-result:
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Errorf("read error is %v, want timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("silent connection is not dropped")
+	}
+	if idleTimeouts.Value() != timeoutsBefore+1 {
+		t.Errorf("idleTimeouts grew by %d, want 1", idleTimeouts.Value()-timeoutsBefore)
+	}
+}
+
+func TestPongsKeepConnection(t *testing.T) {
+	result := make(chan error, 1)
+	server := serveIdleTest(t, 150*time.Millisecond, 30*time.Millisecond, result)
+	defer server.Close()
+	conn := dialIdleTest(t, server)
+	defer conn.Close()
+	// Reading makes client answer pings.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Client sends nothing for longer than max idle time, only pongs.
+	time.Sleep(500 * time.Millisecond)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("connection answering pings is dropped: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message is not read")
+	}
+}
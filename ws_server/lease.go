@@ -0,0 +1,117 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/pbsphp/ShittyPixels/common"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Address other services use to reach instance listening on listenAddress: ws://<hostname>:<port>/.
+// Browsers reach it only through ws_gateway (see GatewayAddress), without gateway provide
+// -advertise with address published to browsers.
+func defaultAdvertiseAddress(listenAddress string) (string, error) {
+	_, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return "", err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return "ws://" + net.JoinHostPort(hostname, port) + "/", nil
+}
+
+// Time until which instance may accept placements. It is ahead of lease expiry by a third of TTL,
+// so instance stops before other one can take shard over. Zero value accepts nothing.
+// Deadline only saves useless redis calls and gives clients early errors: local clock may be off,
+// so placements are fenced by lease in redis anyway (see common.AppendPlacement), that check is authoritative.
+type LeaseDeadline struct {
+	// Unix time in nanoseconds.
+	deadline int64
+}
+
+func (d *LeaseDeadline) extend(renewedAt time.Time, ttl time.Duration) {
+	atomic.StoreInt64(&d.deadline, renewedAt.Add(ttl-ttl/3).UnixNano())
+}
+
+// Is lease certainly held now.
+func (d *LeaseDeadline) Valid() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&d.deadline)
+}
+
+// Renew shard lease until it is lost, then close lost. Lease is lost if it cannot be renewed
+// before deadline or other instance has claimed it. Lease should be acquired just before call.
+func RunLeaseHeartbeat(
+	rdb *redis.Client,
+	lease *common.ShardLease,
+	ttl time.Duration,
+	deadline *LeaseDeadline,
+	lost chan<- struct{},
+) {
+	defer close(lost)
+	deadline.extend(time.Now(), ttl)
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Lease TTL starts before redis gets request.
+		renewedAt := time.Now()
+		renewed, err := lease.Renew(rdb, ttl)
+		if err != nil {
+			logError("renew shard lease", err)
+			if !deadline.Valid() {
+				log.Printf("shard %d lease lost\n", lease.Shard)
+				return
+			}
+			continue
+		}
+		if !renewed {
+			log.Printf("shard %d lease lost\n", lease.Shard)
+			return
+		}
+		deadline.extend(renewedAt, ttl)
+	}
+}
+
+// Check that every shard of shardCount is held by instance, so resharding does not give chunks
+// to shards nobody serves. Shards above shardCount may be held, their instances exit after resharding.
+func checkShardLeases(rdb *redis.Client, shardCount int) error {
+	addresses, err := common.GetShardAddresses(rdb, shardCount)
+	if err != nil {
+		return err
+	}
+	missing := make([]int, 0)
+	for shard, address := range addresses {
+		if address == "" {
+			missing = append(missing, shard)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf(
+			"%d of %d shards are held, start instances for shards %v first", shardCount-len(missing), shardCount, missing)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaseDeadline(t *testing.T) {
+	var d LeaseDeadline
+	if d.Valid() {
+		t.Error("zero deadline is valid")
+	}
+
+	const ttl = 3 * time.Second
+	cases := []struct {
+		renewedAgo time.Duration
+		valid      bool
+	}{
+		{0, true},
+		// Deadline is 2 seconds after renewal, lease itself expires after 3.
+		{time.Second, true},
+		{2*time.Second + 100*time.Millisecond, false},
+		{ttl, false},
+	}
+	for _, c := range cases {
+		d.extend(time.Now().Add(-c.renewedAgo), ttl)
+		if d.Valid() != c.valid {
+			t.Errorf("renewed %v ago: Valid is %v, want %v", c.renewedAgo, d.Valid(), c.valid)
+		}
+	}
+}
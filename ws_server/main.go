@@ -21,17 +21,20 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"expvar"
 	"flag"
 	"github.com/go-redis/redis"
 	"github.com/gorilla/websocket"
 	"github.com/pbsphp/ShittyPixels/common"
-	"golang.org/x/image/colornames"
-	"image/color"
-	"image/png"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 // Color of pixel
@@ -57,74 +60,32 @@ func logError(description string, err error) {
 	log.Println("[ ERROR ]: ", description, err)
 }
 
-type Matrix struct {
-	// Array of colors. Only pixels belonging to this instance.
-	// So len(Data) < Width * Height!
-	Data []Color
-	// Total width of canvas.
-	Width int
-	// Total height of canvas.
-	Height int
-
-	instanceNumber int
-	totalInstances int
-}
-
-func NewMatrix(width, height, instanceNumber, totalInstances int) Matrix {
-	instanceWidth := (width + totalInstances - 1) / totalInstances
-	return Matrix{
-		Data:           make([]Color, instanceWidth*height),
-		Width:          width,
-		Height:         height,
-		instanceNumber: instanceNumber,
-		totalInstances: totalInstances,
-	}
-}
-
-func (m *Matrix) Get(x, y int) (Color, bool) {
-	if x%m.totalInstances != m.instanceNumber {
-		return 0, false
-	}
-
-	instanceX := x / m.totalInstances
-	instanceWidth := (m.Width + m.totalInstances - 1) / m.totalInstances
-
-	return m.Data[y*instanceWidth+instanceX], true
-}
-
-func (m *Matrix) Set(x, y int, val Color) bool {
-	if x%m.totalInstances != m.instanceNumber {
-		return false
-	}
-
-	instanceX := x / m.totalInstances
-	instanceWidth := (m.Width + m.totalInstances - 1) / m.totalInstances
-
-	m.Data[y*instanceWidth+instanceX] = val
-	return true
-}
-
 // Client request should be JSON with:
 // method -- method name ("setPixelColor" for example).
+// canvas -- canvas name (see CanvasConfig).
 // args -- additional args for method (may be nil). Different schema for each method.
-// sessionToken -- session token for user authentication.
+// User is authenticated once, when connection is opened (see authenticate).
 type WebSocketRequestData struct {
-	Method       string                 `json:"method"`
-	Args         map[string]interface{} `json:"args"`
-	SessionToken string                 `json:"sessionToken"`
+	Method string                 `json:"method"`
+	Canvas string                 `json:"canvas"`
+	Args   map[string]interface{} `json:"args"`
 }
 
 // Server message is JSON with:
-// kind -- kind of message ("pixelColor" for example).
-// data -- some data for given kind of message. For "pixelColor" it would be {"x": x, "y": y, "color": color}.
+// kind -- kind of message ("pixelBatch" for example).
+// canvas -- canvas name message relates to.
+// data -- some data for given kind of message. For "pixelBatch" it would be {"pixels": [{"x": x, "y": y, "color": color, "version": version}, ...]}.
 type WebSocketResponseData struct {
-	Kind string      `json:"kind"`
-	Data interface{} `json:"data"`
+	Kind   string      `json:"kind"`
+	Canvas string      `json:"canvas"`
+	Data   interface{} `json:"data"`
 }
 
 // Wrapper around websocket.Conn.
 type WebSocketConnectionWrapper struct {
 	conn *websocket.Conn
+	// Reads fail if nothing comes from client for that long (0 for no limit).
+	maxIdle time.Duration
 }
 
 // Flag for returning from some of the functions.
@@ -156,11 +117,39 @@ func (c *WebSocketConnectionWrapper) Close() error {
 	return c.conn.Close()
 }
 
+// Drop connection if nothing (not even pong) comes from client for given time.
+// Should be called before reading starts.
+func (c *WebSocketConnectionWrapper) SetMaxIdle(maxIdle time.Duration) {
+	c.maxIdle = maxIdle
+	c.extendReadDeadline()
+	c.conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+}
+
+func (c *WebSocketConnectionWrapper) extendReadDeadline() {
+	if c.maxIdle > 0 {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.maxIdle))
+	}
+}
+
+// Read message from web socket as is.
+func (c *WebSocketConnectionWrapper) ReadRawMessage() (int, []byte, error) {
+	mt, message, err := c.conn.ReadMessage()
+	if err == nil {
+		c.extendReadDeadline()
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		idleTimeouts.Add(1)
+	}
+	return mt, message, err
+}
+
 // Read message from web socket and convert to WebSocketRequestData object.
 func (c *WebSocketConnectionWrapper) ReadMessage() (int, *WebSocketRequestData, CanContinueFlag, error) {
 	reqData := WebSocketRequestData{}
 
-	mt, message, err := c.conn.ReadMessage()
+	mt, message, err := c.ReadRawMessage()
 	if err != nil {
 		return mt, &reqData, CanNotContinue, err
 	}
@@ -173,49 +162,74 @@ func (c *WebSocketConnectionWrapper) ReadMessage() (int, *WebSocketRequestData,
 	return mt, &reqData, CanContinue, nil
 }
 
-// Send WebSocketResponseData to connection.
-func (c *WebSocketConnectionWrapper) WriteMessage(mt int, msg *WebSocketResponseData) (CanContinueFlag, error) {
-	response, err := json.Marshal(msg)
-	if err != nil {
-		return CanContinue, err
+// Send prepared message to connection. Should be called from one goroutine only (see Client).
+// Connection is broken if message is not written before deadline.
+func (c *WebSocketConnectionWrapper) WritePreparedMessage(msg *websocket.PreparedMessage, deadline time.Time) error {
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
+		return err
 	}
+	return c.conn.WritePreparedMessage(msg)
+}
+
+// Send ping to connection. Client answers with pong (see SetMaxIdle).
+func (c *WebSocketConnectionWrapper) WritePing(deadline time.Time) error {
+	return c.conn.WriteControl(websocket.PingMessage, nil, deadline)
+}
+
+// Send close frame with given code to connection.
+func (c *WebSocketConnectionWrapper) WriteCloseMessage(code int, text string, deadline time.Time) error {
+	return c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+}
 
-	err = c.conn.WriteMessage(mt, response)
+// Convert WebSocketResponseData to message which may be sent to many connections.
+func prepareResponse(mt int, msg *WebSocketResponseData) (*websocket.PreparedMessage, error) {
+	response, err := json.Marshal(msg)
 	if err != nil {
-		return CanNotContinue, err
+		return nil, err
 	}
-
-	return CanContinue, nil
+	return websocket.NewPreparedMessage(mt, response)
 }
 
 // Pixel representation for transfer: coords and color.
+// Version is matrix version after pixel was changed (see Matrix).
 type PixelInfo struct {
-	X     int   `json:"x"`
-	Y     int   `json:"y"`
-	Color Color `json:"color"`
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Color   Color  `json:"color"`
+	Version uint64 `json:"version"`
 }
 
-// Convert map returned by json.Unmarshal to PixelInfo.
-func argsToPixelInfo(args map[string]interface{}) (*PixelInfo, error) {
+// Read pixel coordinates from map returned by json.Unmarshal.
+func argsToCoords(args map[string]interface{}) (int, int, error) {
 	rawX, ok := args["x"]
 	if !ok {
-		return nil, errors.New("expected 'x' key")
+		return 0, 0, errors.New("expected 'x' key")
 	}
 	rawY, ok := args["y"]
 	if !ok {
-		return nil, errors.New("expected 'y' key")
-	}
-	rawColor, ok := args["color"]
-	if !ok {
-		return nil, errors.New("expected 'color' key")
+		return 0, 0, errors.New("expected 'y' key")
 	}
 	x, ok := rawX.(float64)
 	if !ok {
-		return nil, errors.New("expected 'x':Number key")
+		return 0, 0, errors.New("expected 'x':Number key")
 	}
 	y, ok := rawY.(float64)
 	if !ok {
-		return nil, errors.New("expected 'y':Number key")
+		return 0, 0, errors.New("expected 'y':Number key")
+	}
+
+	return int(x), int(y), nil
+}
+
+// Convert map returned by json.Unmarshal to PixelInfo.
+func argsToPixelInfo(args map[string]interface{}) (*PixelInfo, error) {
+	x, y, err := argsToCoords(args)
+	if err != nil {
+		return nil, err
+	}
+	rawColor, ok := args["color"]
+	if !ok {
+		return nil, errors.New("expected 'color' key")
 	}
 	colorNumber, ok := rawColor.(float64)
 	if !ok {
@@ -223,8 +237,8 @@ func argsToPixelInfo(args map[string]interface{}) (*PixelInfo, error) {
 	}
 
 	return &PixelInfo{
-		X:     int(x),
-		Y:     int(y),
+		X:     x,
+		Y:     y,
 		Color: Color(colorNumber),
 	}, nil
 }
@@ -237,88 +251,16 @@ func isWsClosedOk(err error) bool {
 
 // Read PNG image and draw it on the matrix using closest available color.
 // Panic on failure.
-func MustDrawInitialImage(
-	path string,
-	matrix *Matrix,
-	palette []string,
-	instanceNumber int,
-	totalInstances int,
-) {
-	checkError := func(err error) {
-		if err != nil {
-			panic(err)
-		}
-	}
-
-	pow2 := func(x float32) float32 {
-		return x * x
-	}
-
-	// Transform palette with color names to RGBA
-	paletteRGBA := make([]color.RGBA, len(palette))
-	for i, colorName := range palette {
-		paletteRGBA[i] = colornames.Map[colorName]
-	}
-
-	// Return index of palette color closest to given RGB color.
-	// Distance formula is: (0.3(R1 - R2))^2 + (0.59(G1 - G2))^2 + (0.11(B1 - B2))^2.
-	// See https://stackoverflow.com/a/1847112.
-	getClosestColor := func(first color.RGBA) Color {
-		var minDistance float32
-		var minDistanceColorIndex int
-		for i, second := range paletteRGBA {
-			dist := pow2((float32(first.R)-float32(second.R))*0.3) +
-				pow2((float32(first.G)-float32(second.G))*0.59) +
-				pow2((float32(first.B)-float32(second.B))*0.11)
-
-			if i == 0 || dist < minDistance {
-				minDistance = dist
-				minDistanceColorIndex = i
-			}
-		}
-		return Color(minDistanceColorIndex)
+func MustDrawInitialImage(path string, matrix *Matrix, palette []string) {
+	canvas, err := common.ReadInitialImage(path, palette, matrix.Width, matrix.Height)
+	if err != nil {
+		panic(err)
 	}
 
-	f, err := os.Open(path)
-	checkError(err)
-	defer func() {
-		checkError(f.Close())
-	}()
-
-	img, err := png.Decode(f)
-	checkError(err)
-
-	imgWidth := img.Bounds().Max.X - img.Bounds().Min.X
-	imgHeight := img.Bounds().Max.Y - img.Bounds().Min.Y
-	canvasWidth := matrix.Width
-	canvasHeight := matrix.Height
-
-	repeatX := (canvasWidth + imgWidth - 1) / imgWidth
-	repeatY := (canvasHeight + imgHeight - 1) / imgHeight
-
-	// TODO: Rewrite this loops.
-	for rY := 0; rY < repeatY; rY++ {
-		for rX := 0; rX < repeatX; rX++ {
-			for y := 0; y < imgHeight; y++ {
-				imgY := y + img.Bounds().Min.Y
-				matrixY := rY*imgHeight + y
-				for x := instanceNumber; x < imgWidth; x += totalInstances {
-					imgX := x + img.Bounds().Min.X
-					matrixX := rX*imgWidth + x
-
-					if imgX < img.Bounds().Max.X &&
-						imgY < img.Bounds().Max.Y &&
-						matrixX < canvasWidth &&
-						matrixY < canvasHeight {
-						imgColor := color.RGBAModel.Convert(img.At(imgX, imgY)).(color.RGBA)
-						ok := matrix.Set(matrixX, matrixY, getClosestColor(imgColor))
-						if !ok {
-							// Expected to be unreachable.
-							panic("initial picture drawing failed (unreachable code)")
-						}
-					}
-				}
-			}
+	for y := 0; y < matrix.Height; y++ {
+		for x := 0; x < matrix.Width; x++ {
+			// Pixels of other instances are skipped.
+			matrix.Set(x, y, Color(canvas[y*matrix.Width+x]))
 		}
 	}
 }
@@ -329,58 +271,63 @@ type WebSocketHandler struct {
 	appConfig      *common.AppConfig
 	upgraderConfig websocket.Upgrader
 
-	allConnections map[*WebSocketConnectionWrapper]struct{}
-	matrix         *Matrix
+	// Canvases by name.
+	canvases map[string]*Canvas
+	// Subscriptions of clients to canvas events.
+	hub *Hub
 
 	instanceNumber int
-	totalInstances int
+	// Id of this process in published placements (see RunRelay).
+	publisherId string
+	// Lease of shard held by this instance. Placements are logged only while it is held.
+	lease         *common.ShardLease
+	leaseDeadline *LeaseDeadline
 }
 
 func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	c, err := NewWebSocketConnectionWrapper(&h.upgraderConfig, w, r)
+	identity := mustAuthenticate(h.rdb, h.appConfig, w, r)
+	if identity == nil {
+		return
+	}
+
+	conn, err := NewWebSocketConnectionWrapper(&h.upgraderConfig, w, r)
 	if err != nil {
 		logError("upgrade", err)
 		return
 	}
-	defer func() {
-		if err := c.Close(); err != nil {
-			logError("close connection", err)
-		}
-	}()
+	// Client writer goroutine closes connection when client is unregistered.
+	c := NewClient(conn, h.appConfig)
+	defer h.hub.Unregister(c)
 
 	for {
-		mt, wsMessage, canContinue, err := c.ReadMessage()
+		mt, wsMessage, canContinue, err := conn.ReadMessage()
 		if err != nil {
 			if !isWsClosedOk(err) {
 				logError("read websocket request", err)
 			}
 
-			delete(h.allConnections, c)
-
 			if canContinue == CanContinue {
 				continue
 			}
 			return
 		}
 
-		// Check that user is authenticated (session has Login)
-		// Check that user logged in (has active session with login)
-		session, err := common.GetSessionBySessionId(h.rdb, wsMessage.SessionToken)
-		if err != nil {
-			logError("get session info", err)
-			continue
-		}
-		if session == nil || session.Login == "" {
-			// Cheating? Ignore request.
+		canvas, ok := h.canvases[wsMessage.Canvas]
+		if !ok {
+			logError("unknown canvas", nil)
 			continue
 		}
 
 		canContinue = CanContinue
 		switch wsMessage.Method {
 		case "setPixelColor":
-			canContinue = h.handleSetPixelColor(wsMessage, mt, c)
+			canContinue = h.handleSetPixelColor(wsMessage, canvas, identity, mt, c)
 		case "connectMe":
-			canContinue = h.handleConnectMe(wsMessage, mt, c)
+			canContinue = h.handleConnectMe(wsMessage, canvas, identity, mt, c)
+		case "resume":
+			canContinue = h.handleResume(wsMessage, canvas, identity, mt, c)
+		case "getPixelInfo":
+			canContinue = h.handleGetPixelInfo(wsMessage, canvas, identity, mt, c)
 		default:
 			logError("unsupported method", nil)
 		}
@@ -392,27 +339,50 @@ func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// Send response to one client.
+func (h *WebSocketHandler) reply(c *Client, mt int, wsResponse *WebSocketResponseData) CanContinueFlag {
+	msg, err := prepareResponse(mt, wsResponse)
+	if err != nil {
+		logError("marshal response", err)
+		return CanContinue
+	}
+	if !c.Send(msg) {
+		// Outbound queue is overflowed or closed.
+		return CanNotContinue
+	}
+	return CanContinue
+}
+
 // Handle setPixelColor method.
 //
 // User is changing pixel color.
 // Expected JSON:
-// {
-//     "method": "setPixelColor",
-//     "data": {
-//         "x": <X coordinate>,
-//         "y": <Y coordinate>,
-//         "color": "<new color>"
-//     }
-// }
-// All open connections get event notification:
-// {
-//     "kind": "pixelColor",
-//     "data": { (same) }
-// }
+//
+//	{
+//	    "method": "setPixelColor",
+//	    "data": {
+//	        "x": <X coordinate>,
+//	        "y": <Y coordinate>,
+//	        "color": "<new color>"
+//	    }
+//	}
+//
+// All open connections get event notification with other changes made during broadcast tick
+// (only last change of each pixel is sent):
+//
+//	{
+//	    "kind": "pixelBatch",
+//	    "data": {
+//	        "instance": <instance number, versions are versions of its matrix>,
+//	        "pixels": [{ (same), "version": <matrix version after change> }, ...]
+//	    }
+//	}
 func (h *WebSocketHandler) handleSetPixelColor(
 	wsMessage *WebSocketRequestData,
+	canvas *Canvas,
+	identity *common.WebSocketIdentity,
 	mt int,
-	c *WebSocketConnectionWrapper,
+	c *Client,
 ) CanContinueFlag {
 	pixel, err := argsToPixelInfo(wsMessage.Args)
 	if err != nil {
@@ -421,7 +391,17 @@ func (h *WebSocketHandler) handleSetPixelColor(
 		return CanContinue
 	}
 
-	err, hasOldCooldown := common.TestAndUpdateSessionCooldown(h.rdb, h.appConfig, wsMessage.SessionToken)
+	if !canvas.matrix.Owns(pixel.X, pixel.Y) {
+		// This pixel is managed by other worker.
+		// Ignore request.
+		return CanContinue
+	}
+	if int(pixel.Color) >= len(canvas.config.PaletteColors) {
+		// No such color. Ignore request.
+		return CanContinue
+	}
+
+	err, hasOldCooldown := common.TestAndUpdateUserCooldown(h.rdb, canvas.config, identity.Login)
 	if err != nil {
 		logError("update redis cooldown", err)
 		return CanContinue
@@ -431,152 +411,403 @@ func (h *WebSocketHandler) handleSetPixelColor(
 		return CanContinue
 	}
 
-	ok := h.matrix.Set(pixel.X, pixel.Y, pixel.Color)
-	if !ok {
-		// This pixel is managed by other worker.
-		// Ignore request.
-		return CanContinue
-	}
-
-	log.Printf("setPixelColor(x=%d, y=%d, color(code)=%d)\n", pixel.X, pixel.Y, pixel.Color)
-
-	wsResponse := WebSocketResponseData{
-		Kind: "pixelColor",
-		Data: pixel,
+	// Placement is accepted only after it is written to log.
+	// Log rejects it if pixel may belong to other instance already (see common.Reshard).
+	// Lease not renewed for long may be taken over before placement is logged, so placements stop before that.
+	canvas.placementMu.Lock()
+	placementId := ""
+	err = common.ErrShardLeaseLost
+	if h.leaseDeadline.Valid() {
+		placementId, err = common.AppendPlacement(h.rdb, &common.PlacementEvent{
+			Canvas: canvas.config.Name,
+			Login:  identity.Login,
+			X:      pixel.X,
+			Y:      pixel.Y,
+			Color:  uint8(pixel.Color),
+			Shard:  h.instanceNumber,
+			Time:   time.Now().UnixNano() / int64(time.Millisecond),
+		}, canvas.matrix.MapVersion(), h.lease)
 	}
-
-	// Notify all connections.
-	// Also collect invalid connections and remove them from `allConnections' list.
-	invalidConnections := make([]*WebSocketConnectionWrapper, 0, 1)
-	for conn := range h.allConnections {
-		canContinue, err := conn.WriteMessage(mt, &wsResponse)
-		if err != nil && !isWsClosedOk(err) {
-			logError("write response (broadcast)", err)
-		}
-		if canContinue == CanNotContinue {
-			invalidConnections = append(invalidConnections, conn)
+	if err != nil {
+		canvas.placementMu.Unlock()
+		logError("append placement", err)
+		// Placement is lost (resharding, lease lost or redis failure), user should not wait for nothing.
+		if err := common.ClearUserCooldown(h.rdb, canvas.config.Name, identity.Login); err != nil {
+			logError("clear cooldown", err)
 		}
+		return CanContinue
 	}
-
-	canContinue := CanContinue
-	for _, conn := range invalidConnections {
-		delete(h.allConnections, conn)
-
-		if conn == c {
-			canContinue = CanNotContinue
-		}
+	pixel.Version, _ = canvas.matrix.Apply(pixel.X, pixel.Y, pixel.Color, placementId)
+
+	// Broadcast under the same lock, so events go out in version order.
+	h.hub.BroadcastPixel(canvas, h.instanceNumber, pixel)
+	// Other instances relay placement to their clients.
+	err = common.PublishPlacement(h.rdb, &common.LivePlacement{
+		Publisher: h.publisherId,
+		Canvas:    canvas.config.Name,
+		Shard:     h.instanceNumber,
+		X:         pixel.X,
+		Y:         pixel.Y,
+		Color:     uint8(pixel.Color),
+		Version:   pixel.Version,
+	})
+	canvas.placementMu.Unlock()
+	canvas.checkpointer.NotifyPlacement()
+	if err != nil {
+		logError("publish placement", err)
 	}
 
-	return canContinue
+	log.Printf(
+		"setPixelColor(canvas=%s, x=%d, y=%d, color(code)=%d, login=%s, id=%s)\n",
+		canvas.config.Name, pixel.X, pixel.Y, pixel.Color, identity.Login, placementId,
+	)
+
+	return CanContinue
 }
 
 // Handle connectMe method
 //
 // New user is connected.
 // Expected JSON:
-// {
-//     "method": "connectMe"
-// }
+//
+//	{
+//	    "method": "connectMe",
+//	    "args": {
+//	        "binary": <true for binary protocol, see protocol.go>,
+//	        "ownEventsOnly": <true to skip pixelBatch events of other instances>
+//	    } (optional)
+//	}
+//
 // User should get event:
-// {
-//     "kind": "allPixelsColors",
-//     "data": [
-//         pixelColor,
-//         anotherPixelColor,
-// 		   ...
-//     ]
-// }
+//
+//	{
+//	    "kind": "shardMap",
+//	    "data": (see prepareShardMapMessage)
+//	}
+//
+//	{
+//	    "kind": "allPixelsColors",
+//	    "data": {
+//	        "colorCodes": [pixelColor, anotherPixelColor, ...],
+//	        "instance": <instance number>,
+//	        "chunkSize": <chunk size>,
+//	        "version": <matrix version>,
+//	        "epoch": <matrix epoch, needed for resume>
+//	    }
+//	}
+//
+// Color codes are chunks owned by instance (see common.InstanceLayout).
+// Pixels of pixelBatch events with version <= snapshot version are already included into snapshot.
+// Then user gets pixelBatch events of the whole canvas (see relay.go). Versions of events are
+// versions of matrix of instance owning the pixel, so they are comparable only with snapshot of that instance.
 func (h *WebSocketHandler) handleConnectMe(
 	wsMessage *WebSocketRequestData,
+	canvas *Canvas,
+	identity *common.WebSocketIdentity,
 	mt int,
-	c *WebSocketConnectionWrapper,
+	c *Client,
 ) CanContinueFlag {
-	log.Printf("connectMe()\n")
+	log.Printf("connectMe(canvas=%s)\n", canvas.config.Name)
+	return h.subscribe(wsMessage, canvas, identity, mt, c, false)
+}
 
-	_, ok := h.allConnections[c]
-	if !ok {
-		h.allConnections[c] = struct{}{}
+// Handle resume method
+//
+// User has reconnected and wants only changes made since the last event received.
+// Expected JSON:
+//
+//	{
+//	    "method": "resume",
+//	    "args": {
+//	        (same as for connectMe),
+//	        "positions": {
+//	            "<instance number>": {"epoch": <epoch of snapshot>, "version": <last seen version>},
+//	            ...
+//	        }
+//	    }
+//	}
+//
+// Positions of several instances may be sent (gateway sends request to all instances), each instance takes its own.
+// User should get shardMap event and then missed changes:
+//
+//	{
+//	    "kind": "resumed",
+//	    "data": {
+//	        "instance": <instance number>,
+//	        "epoch": <matrix epoch>,
+//	        "version": <matrix version>,
+//	        "pixels": [{"x": x, "y": y, "color": color, "version": version}, ...]
+//	    }
+//	}
+//
+// Result is the same as snapshot with given version. If changes are not available anymore
+// (too old or instance was restarted), user gets allPixelsColors snapshot as for connectMe.
+// Only changes of this instance are replayed, changes of other instances should be asked from them.
+func (h *WebSocketHandler) handleResume(
+	wsMessage *WebSocketRequestData,
+	canvas *Canvas,
+	identity *common.WebSocketIdentity,
+	mt int,
+	c *Client,
+) CanContinueFlag {
+	log.Printf("resume(canvas=%s)\n", canvas.config.Name)
+	return h.subscribe(wsMessage, canvas, identity, mt, c, true)
+}
+
+// Read position of this instance from resume request.
+func argsToResumePosition(args map[string]interface{}, instance int) (epoch, version uint64, ok bool) {
+	positions, _ := args["positions"].(map[string]interface{})
+	position, _ := positions[strconv.Itoa(instance)].(map[string]interface{})
+	rawEpoch, okEpoch := position["epoch"].(float64)
+	rawVersion, okVersion := position["version"].(float64)
+	if !okEpoch || !okVersion || rawEpoch < 0 || rawVersion < 0 {
+		return 0, 0, false
+	}
+	return uint64(rawEpoch), uint64(rawVersion), true
+}
+
+// Subscribe client to canvas events and send canvas state: missed changes when resuming or snapshot.
+func (h *WebSocketHandler) subscribe(
+	wsMessage *WebSocketRequestData,
+	canvas *Canvas,
+	identity *common.WebSocketIdentity,
+	mt int,
+	c *Client,
+	resume bool,
+) CanContinueFlag {
+	binaryProtocol, _ := wsMessage.Args["binary"].(bool)
+	ownEventsOnly, _ := wsMessage.Args["ownEventsOnly"].(bool)
+
+	// Subscribe before reading matrix, so no event is lost in between.
+	h.hub.Register(c, canvas.config.Name, binaryProtocol, ownEventsOnly)
+
+	if resume {
+		layout := canvas.matrix.Layout()
+		mapVersion := canvas.matrix.MapVersion()
+		epoch, version, ok := argsToResumePosition(wsMessage.Args, layout.Instance)
+		var pixels []PixelInfo
+		if ok {
+			pixels, version, ok = canvas.matrix.ChangesSince(epoch, version)
+		}
+		if ok {
+			if !h.sendShardMap(canvas, layout, mapVersion, c) {
+				return CanNotContinue
+			}
+			wsResponse := WebSocketResponseData{
+				Kind:   "resumed",
+				Canvas: canvas.config.Name,
+				Data: struct {
+					Instance int         `json:"instance"`
+					Epoch    uint64      `json:"epoch"`
+					Version  uint64      `json:"version"`
+					Pixels   []PixelInfo `json:"pixels"`
+				}{
+					Instance: layout.Instance,
+					Epoch:    epoch,
+					Version:  version,
+					Pixels:   pixels,
+				},
+			}
+			if h.reply(c, websocket.TextMessage, &wsResponse) == CanNotContinue {
+				return CanNotContinue
+			}
+			return h.sendCooldownInfo(identity, canvas, mt, c)
+		}
+	}
+
+	snapshot := canvas.matrix.Snapshot()
+	if !h.sendShardMap(canvas, snapshot.Layout, snapshot.MapVersion, c) {
+		return CanNotContinue
+	}
+
+	if binaryProtocol {
+		msg, err := websocket.NewPreparedMessage(
+			websocket.BinaryMessage,
+			encodeBinarySnapshot(
+				canvas.index,
+				len(canvas.config.PaletteColors),
+				&snapshot,
+				snapshot.Layout.Instance,
+				snapshot.Layout.ChunkSize,
+			),
+		)
+		if err != nil {
+			logError("prepare snapshot", err)
+			return CanNotContinue
+		}
+		if !c.Send(msg) {
+			return CanNotContinue
+		}
+		return h.sendCooldownInfo(identity, canvas, mt, c)
 	}
 
 	wsResponse := WebSocketResponseData{
-		Kind: "allPixelsColors",
+		Kind:   "allPixelsColors",
+		Canvas: canvas.config.Name,
 		Data: struct {
 			ColorCodes []Color `json:"colorCodes"`
-			Offset     int     `json:"offset"`
-			EachNth    int     `json:"eachNth"`
+			Instance   int     `json:"instance"`
+			ChunkSize  int     `json:"chunkSize"`
+			Version    uint64  `json:"version"`
+			Epoch      uint64  `json:"epoch"`
 		}{
-			ColorCodes: h.matrix.Data,
-			Offset:     h.instanceNumber,
-			EachNth:    h.totalInstances,
+			ColorCodes: snapshot.Data,
+			Instance:   snapshot.Layout.Instance,
+			ChunkSize:  snapshot.Layout.ChunkSize,
+			Version:    snapshot.Version,
+			Epoch:      snapshot.Epoch,
 		},
 	}
-	canContinue, err := c.WriteMessage(mt, &wsResponse)
+	if h.reply(c, mt, &wsResponse) == CanNotContinue {
+		return CanNotContinue
+	}
+
+	return h.sendCooldownInfo(identity, canvas, mt, c)
+}
+
+// Send shard map with layout of matrix. Client may have older one.
+// Return false if client is gone.
+func (h *WebSocketHandler) sendShardMap(canvas *Canvas, layout *common.InstanceLayout, mapVersion int64, c *Client) bool {
+	shardMapMsg, err := prepareShardMapMessage(h.rdb, h.appConfig, canvas, layout.CanvasLayout, mapVersion)
 	if err != nil {
-		if !isWsClosedOk(err) {
-			logError("write response", err)
-		}
-		delete(h.allConnections, c)
-		return canContinue
+		logError("prepare shard map", err)
+		return false
 	}
+	return c.Send(shardMapMsg)
+}
 
-	// Also send cooldown info (if present)
-	cooldown, err := common.GetSessionCooldownBySessionId(h.rdb, wsMessage.SessionToken)
+// Send cooldown info (if present).
+func (h *WebSocketHandler) sendCooldownInfo(
+	identity *common.WebSocketIdentity,
+	canvas *Canvas,
+	mt int,
+	c *Client,
+) CanContinueFlag {
+	cooldown, err := common.GetUserCooldown(h.rdb, canvas.config.Name, identity.Login)
 	if err != nil {
 		logError("redis read cooldown", err)
 		return CanNotContinue
 	}
 	if cooldown > 0 {
 		wsResponse := WebSocketResponseData{
-			Kind: "cooldownInfo",
-			Data: cooldown,
+			Kind:   "cooldownInfo",
+			Canvas: canvas.config.Name,
+			Data:   cooldown,
 		}
-		canContinue, err := c.WriteMessage(mt, &wsResponse)
-		if err != nil {
-			if !isWsClosedOk(err) {
-				logError("write response", err)
-			}
-			delete(h.allConnections, c)
-			return canContinue
+		if h.reply(c, mt, &wsResponse) == CanNotContinue {
+			return CanNotContinue
 		}
 	}
 
 	return CanContinue
 }
 
+// Handle getPixelInfo method.
+//
+// User wants to know who placed pixel and when.
+// Expected JSON:
+//
+//	{
+//	    "method": "getPixelInfo",
+//	    "args": {
+//	        "x": <X coordinate>,
+//	        "y": <Y coordinate>
+//	    }
+//	}
+//
+// User should get event:
+//
+//	{
+//	    "kind": "pixelInfo",
+//	    "data": {
+//	        "x": <X coordinate>,
+//	        "y": <Y coordinate>,
+//	        "color": <color code>,
+//	        "login": "<login of last placer or empty string>",
+//	        "time": <unix time of placement in milliseconds or 0>
+//	    }
+//	}
+func (h *WebSocketHandler) handleGetPixelInfo(
+	wsMessage *WebSocketRequestData,
+	canvas *Canvas,
+	identity *common.WebSocketIdentity,
+	mt int,
+	c *Client,
+) CanContinueFlag {
+	x, y, err := argsToCoords(wsMessage.Args)
+	if err != nil {
+		// Problems with user data. Just ignore.
+		logError("unmarshal (data)", err)
+		return CanContinue
+	}
+
+	color, ok := canvas.matrix.Get(x, y)
+	if !ok {
+		// This pixel is managed by other worker.
+		// Ignore request.
+		return CanContinue
+	}
+
+	attribution, err := common.GetPixelAttribution(h.rdb, canvas.config.Name, x, y)
+	if err != nil {
+		logError("redis read pixel attribution", err)
+		return CanContinue
+	}
+	if attribution == nil {
+		// Pixel is from initial image.
+		attribution = &common.PixelAttribution{}
+	}
+
+	wsResponse := WebSocketResponseData{
+		Kind:   "pixelInfo",
+		Canvas: canvas.config.Name,
+		Data: struct {
+			X     int    `json:"x"`
+			Y     int    `json:"y"`
+			Color Color  `json:"color"`
+			Login string `json:"login"`
+			Time  int64  `json:"time"`
+		}{
+			X:     x,
+			Y:     y,
+			Color: color,
+			Login: attribution.Login,
+			Time:  attribution.Time,
+		},
+	}
+	return h.reply(c, mt, &wsResponse)
+}
+
 func main() {
-	instanceNumberFlag := flag.Int("n", -1, "instance number")
+	instanceNumberFlag := flag.Int("n", -1, "shard number to claim (default: first free shard)")
 	listenAddressFlag := flag.String("listen", "", "address to listen")
+	advertiseAddressFlag := flag.String("advertise", "", "address to reach this instance, must be reachable by browsers if GatewayAddress is empty (default: ws://<hostname>:<listen port>/)")
+	gatewayFlag := flag.Bool("gateway", false, "run as gateway in front of all instances (see gateway.go)")
+	reshardFlag := flag.Bool("reshard", false, "move canvases to layouts from config and exit (see common.Reshard)")
+	metricsAddressFlag := flag.String("metrics", "", "internal address to serve counters at /debug/vars (default: not served)")
 	flag.Parse()
 
 	appConfig := common.MustReadAppConfig("config.json")
 
-	instanceNumber := *instanceNumberFlag
-	totalInstances := len(appConfig.WebSocketAppAddresses)
-	if instanceNumber < 0 || instanceNumber > totalInstances {
-		panic("provide -n=x argument (0 <= x < len(WebSocketAppAddresses))")
-	}
 	listenAddress := *listenAddressFlag
-	if listenAddress == "" {
+	if listenAddress == "" && !*reshardFlag {
 		panic("provide -listen=[host]:port")
 	}
 
-	// List of all connections.
-	// We store all websocket connections with active users. When someone has changed pixel color we iterate over
-	// `allConnections' and notify each user about changes.
-	allConnections := make(map[*WebSocketConnectionWrapper]struct{})
-
-	// Allocate canvas matrix. Items are colors.
-	matrix := NewMatrix(appConfig.CanvasCols, appConfig.CanvasRows, instanceNumber, totalInstances)
-
-	MustDrawInitialImage(
-		appConfig.InitialImage,
-		&matrix,
-		appConfig.PaletteColors,
-		instanceNumber,
-		totalInstances,
-	)
+	allowedOriginPattern := regexp.MustCompile(appConfig.AllowedOrigins)
+	upgraderConfig := websocket.Upgrader{
+		// Browsers close connection unless one of offered subprotocols is selected (see common.TicketSubprotocols).
+		Subprotocols: []string{common.WebSocketSubprotocol},
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header["Origin"]
+			if len(origin) == 0 {
+				return true
+			}
+			return allowedOriginPattern.MatchString(origin[0])
+		},
+	}
 
-	// Redis connection. Redis stores session info and cooldowns.
+	// Redis connection. Redis stores session info, cooldowns, canvas checkpoints, placement log and shard leases.
 	rdb := redis.NewClient(&redis.Options{
 		Addr:     appConfig.RedisAddress,
 		Password: appConfig.RedisPassword,
@@ -587,29 +818,153 @@ func main() {
 		log.Fatal("cannot connect to redis server", err)
 	}
 
-	allowedOriginPattern := regexp.MustCompile(appConfig.AllowedOrigins)
-	upgraderConfig := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			origin := r.Header["Origin"]
-			if len(origin) == 0 {
-				return true
+	if *reshardFlag {
+		// Chunks of shard nobody holds would be unavailable until its instance is started.
+		if err := checkShardLeases(rdb, appConfig.ShardCount); err != nil {
+			log.Fatal("cannot reshard: ", err)
+		}
+		for i := range appConfig.Canvases {
+			canvasConfig := &appConfig.Canvases[i]
+			shardMap, err := common.Reshard(rdb, canvasConfig, appConfig.ShardCount)
+			if err != nil {
+				log.Fatalf("cannot reshard canvas %s: %v", canvasConfig.Name, err)
 			}
-			return allowedOriginPattern.MatchString(origin[0])
-		},
+			log.Printf("canvas %s: shard map %d, %d shards\n", canvasConfig.Name, shardMap.Version, shardMap.Layout.Shards)
+		}
+		return
 	}
 
+	if *gatewayFlag {
+		go serveMetrics(*metricsAddressFlag)
+		log.Fatal(http.ListenAndServe(listenAddress, NewGatewayHandler(rdb, appConfig, upgraderConfig)))
+	}
+
+	totalInstances := appConfig.ShardCount
+	if *instanceNumberFlag >= totalInstances {
+		panic("provide -n=x argument (0 <= x < ShardCount) or omit it")
+	}
+	advertiseAddress := *advertiseAddressFlag
+	if advertiseAddress == "" {
+		advertiseAddress, err = defaultAdvertiseAddress(listenAddress)
+		if err != nil {
+			log.Fatal("cannot make advertise address, provide -advertise: ", err)
+		}
+	}
+
+	// Claim shard before loading canvases, they depend on shard number.
+	// If all shards are taken, become replica of the least replicated one (or of -n shard).
+	leaseTTL := common.ShardLeaseTTL(appConfig)
+	lease, err := common.AcquireShardLease(rdb, totalInstances, *instanceNumberFlag, advertiseAddress, leaseTTL)
+	isReplica := err == common.ErrNoFreeShards
+	if isReplica {
+		shard := *instanceNumberFlag
+		if shard < 0 {
+			shard, err = common.LeastReplicatedShard(rdb, totalInstances)
+		}
+		if err == nil {
+			lease, err = common.NewShardLease(shard, advertiseAddress)
+		}
+	}
+	if err != nil {
+		log.Fatal("cannot claim shard: ", err)
+	}
+	leaseDeadline := &LeaseDeadline{}
+	leaseLost := make(chan struct{})
+	if !isReplica {
+		go RunLeaseHeartbeat(rdb, lease, leaseTTL, leaseDeadline, leaseLost)
+	}
+	instanceNumber := lease.Shard
+
+	// Restore all canvases.
+	canvases := make(map[string]*Canvas)
+	for i := range appConfig.Canvases {
+		canvas := MustLoadCanvas(rdb, i, appConfig, instanceNumber)
+		canvases[canvas.config.Name] = canvas
+	}
+
+	hub := NewHub(time.Duration(appConfig.BroadcastTickMilliseconds) * time.Millisecond)
+	go hub.Run()
+	// Closed when resharding removes shard of this instance.
+	retired := make(chan struct{})
+	go RunShardMapWatcher(rdb, appConfig, canvases, hub, retired)
+
+	if isReplica {
+		if err := RunReplica(rdb, canvases, lease, leaseTTL); err != nil {
+			log.Fatal("cannot take over shard: ", err)
+		}
+		go RunLeaseHeartbeat(rdb, lease, leaseTTL, leaseDeadline, leaseLost)
+	}
+	log.Printf("serving shard %d at %s\n", instanceNumber, advertiseAddress)
+
+	// Save checkpoints, so canvas can be assembled from them (see common.LoadCanvas), and keep saving them.
+	for _, canvas := range canvases {
+		if err := canvas.checkpointer.Save(); err == common.ErrShardMapChanged {
+			// Resharding is in progress. Canvas is reloaded when it is finished.
+			log.Printf("canvas %s: shard map is changing\n", canvas.config.Name)
+		} else if err != nil {
+			log.Panic("cannot save checkpoint: ", err)
+		}
+		go canvas.checkpointer.Run()
+	}
+	publisherId, err := newPublisherId()
+	if err != nil {
+		log.Fatal("cannot make publisher id: ", err)
+	}
+	go RunRelay(rdb, canvases, hub, publisherId)
+
+	// Save checkpoints on shutdown, so redeploy does not lose recent pixels.
+	// Then release shard, so replacement instance does not wait for lease expiry.
+	// Checkpoints are also saved when lease is lost: new owner may not have loaded shard yet,
+	// and stored checkpoint is never replaced with older one (see common.StoreCanvasSnapshot).
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+		case <-leaseLost:
+			saveCheckpoints(canvases)
+			log.Fatalf("shard %d is lost, exiting\n", instanceNumber)
+		case <-retired:
+			// Canvas data of shard is moved to other shards already, nothing to save.
+			log.Printf("shard %d is removed by resharding, exiting\n", instanceNumber)
+			if err := lease.Release(rdb); err != nil {
+				logError("release shard lease", err)
+			}
+			os.Exit(0)
+		}
+		saveCheckpoints(canvases)
+		if err := lease.Release(rdb); err != nil {
+			logError("release shard lease", err)
+		}
+		os.Exit(0)
+	}()
+
 	handler := WebSocketHandler{
 		rdb:            rdb,
 		appConfig:      appConfig,
 		upgraderConfig: upgraderConfig,
 
-		allConnections: allConnections,
-		matrix:         &matrix,
+		canvases: canvases,
+		hub:      hub,
 
 		instanceNumber: instanceNumber,
-		totalInstances: totalInstances,
+		publisherId:    publisherId,
+		lease:          lease,
+		leaseDeadline:  leaseDeadline,
 	}
 
-	http.Handle("/", &handler)
-	log.Fatal(http.ListenAndServe(listenAddress, nil))
+	go serveMetrics(*metricsAddressFlag)
+	// Handler is served without http.DefaultServeMux: expvar registers /debug/vars there.
+	log.Fatal(http.ListenAndServe(listenAddress, &handler))
+}
+
+// Serve counters of expvar package (see hub.go) at /debug/vars. They include command line
+// and memory stats, so address should be reachable only from internal network.
+func serveMetrics(address string) {
+	if address == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	log.Fatal(http.ListenAndServe(address, mux))
 }
@@ -0,0 +1,247 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/pbsphp/ShittyPixels/common"
+	"sync"
+	"time"
+)
+
+// Default number of recent changes kept for resuming clients.
+const defaultHistoryLength = 4096
+
+// Recent changes of matrix in version order. Oldest changes are overwritten when buffer is full.
+// Versions of changes in buffer are consecutive, so buffer is cleared when version changes without pixel change.
+type pixelHistory struct {
+	pixels []PixelInfo
+	// Position of oldest change.
+	start int
+	count int
+}
+
+func (h *pixelHistory) push(pixel PixelInfo) {
+	if len(h.pixels) == 0 {
+		return
+	}
+	if h.count < len(h.pixels) {
+		h.pixels[(h.start+h.count)%len(h.pixels)] = pixel
+		h.count++
+		return
+	}
+	h.pixels[h.start] = pixel
+	h.start = (h.start + 1) % len(h.pixels)
+}
+
+func (h *pixelHistory) clear() {
+	h.start = 0
+	h.count = 0
+}
+
+// Changes made after given version, `current' is version of the latest change.
+// Return false if some of them are not in buffer anymore.
+func (h *pixelHistory) since(version, current uint64) ([]PixelInfo, bool) {
+	if version > current || current-version > uint64(h.count) {
+		return nil, false
+	}
+	missed := int(current - version)
+	pixels := make([]PixelInfo, missed)
+	for i := range pixels {
+		pixels[i] = h.pixels[(h.start+h.count-missed+i)%len(h.pixels)]
+	}
+	return pixels, true
+}
+
+// Part of canvas managed by this instance. Safe for concurrent use.
+type Matrix struct {
+	// Array of colors. Only chunks belonging to this instance (see common.InstanceLayout).
+	Data []Color
+	// Total width of canvas.
+	Width int
+	// Total height of canvas.
+	Height int
+
+	// Guards Data, version, history, lastPlacementId, layout and mapVersion.
+	mu sync.RWMutex
+	// Incremented on every change. Lets clients line up pixelBatch events with allPixelsColors snapshot.
+	// Serves as sequence number of changes for resuming clients (see ChangesSince).
+	version uint64
+	// Time matrix was created in milliseconds. Versions of different matrices are not comparable.
+	epoch   uint64
+	history pixelHistory
+	// Id of last placement applied to matrix (see common.PlacementEvent).
+	lastPlacementId string
+
+	layout *common.InstanceLayout
+	// Version of shard map with layout (see common.ShardMap).
+	mapVersion int64
+}
+
+// Consistent copy of matrix state.
+type MatrixSnapshot struct {
+	Data            []Color
+	Version         uint64
+	Epoch           uint64
+	LastPlacementId string
+	Layout          *common.InstanceLayout
+	MapVersion      int64
+}
+
+// Create matrix keeping `historyLength' recent changes for resuming clients.
+func NewMatrix(shardMap *common.ShardMap, instanceNumber int, historyLength int) Matrix {
+	if historyLength <= 0 {
+		historyLength = defaultHistoryLength
+	}
+	instanceLayout := shardMap.Layout.ForInstance(instanceNumber)
+	return Matrix{
+		Data:       make([]Color, instanceLayout.DataSize()),
+		Width:      shardMap.Layout.Width,
+		Height:     shardMap.Layout.Height,
+		epoch:      uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		history:    pixelHistory{pixels: make([]PixelInfo, historyLength)},
+		layout:     instanceLayout,
+		mapVersion: shardMap.Version,
+	}
+}
+
+// Is pixel (x, y) managed by this instance.
+func (m *Matrix) Owns(x, y int) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.layout.Index(x, y) >= 0
+}
+
+func (m *Matrix) Get(x, y int) (Color, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := m.layout.Index(x, y)
+	if i < 0 {
+		return 0, false
+	}
+	return m.Data[i], true
+}
+
+func (m *Matrix) Set(x, y int, val Color) bool {
+	_, ok := m.Apply(x, y, val, "")
+	return ok
+}
+
+// Set pixel color and remember placement id. Empty `placementId' keeps old one.
+// Return new matrix version.
+func (m *Matrix) Apply(x, y int, val Color, placementId string) (uint64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.layout.Index(x, y)
+	if i < 0 {
+		return 0, false
+	}
+	m.Data[i] = val
+	m.version++
+	m.history.push(PixelInfo{X: x, Y: y, Color: val, Version: m.version})
+	if placementId != "" {
+		m.lastPlacementId = placementId
+	}
+	return m.version, true
+}
+
+// Return copy of matrix data with its version and id of last applied placement.
+func (m *Matrix) Snapshot() MatrixSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data := make([]Color, len(m.Data))
+	copy(data, m.Data)
+	return MatrixSnapshot{
+		Data:            data,
+		Version:         m.version,
+		Epoch:           m.epoch,
+		LastPlacementId: m.lastPlacementId,
+		Layout:          m.layout,
+		MapVersion:      m.mapVersion,
+	}
+}
+
+// Take layout and data of other matrix (made for newer shard map). Version keeps growing.
+func (m *Matrix) Replace(other *Matrix) {
+	snapshot := other.Snapshot()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Data = snapshot.Data
+	m.version++
+	m.history.clear()
+	m.lastPlacementId = snapshot.LastPlacementId
+	m.layout = snapshot.Layout
+	m.mapVersion = snapshot.MapVersion
+}
+
+// Changes made after given version of matrix with given epoch and current version.
+// Return false if changes are not available anymore (client needs snapshot then).
+func (m *Matrix) ChangesSince(epoch, version uint64) ([]PixelInfo, uint64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if epoch != m.epoch {
+		return nil, 0, false
+	}
+	pixels, ok := m.history.since(version, m.version)
+	return pixels, m.version, ok
+}
+
+func (m *Matrix) Layout() *common.InstanceLayout {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.layout
+}
+
+func (m *Matrix) MapVersion() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.mapVersion
+}
+
+// Replace matrix data with given one. Return false if data has wrong size.
+func (m *Matrix) Restore(data []Color, lastPlacementId string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(data) != len(m.Data) {
+		return false
+	}
+	copy(m.Data, data)
+	m.version++
+	m.history.clear()
+	m.lastPlacementId = lastPlacementId
+	return true
+}
+
+// Remember placement id without changing pixels.
+func (m *Matrix) SkipPlacement(placementId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastPlacementId = placementId
+}
+
+func (m *Matrix) LastPlacementId() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastPlacementId
+}
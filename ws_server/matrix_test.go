@@ -0,0 +1,124 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/pbsphp/ShittyPixels/common"
+	"reflect"
+	"testing"
+)
+
+func TestPixelHistory(t *testing.T) {
+	h := pixelHistory{pixels: make([]PixelInfo, 3)}
+	pixel := func(version uint64) PixelInfo {
+		return PixelInfo{X: int(version), Y: 1, Color: Color(version % 4), Version: version}
+	}
+
+	cases := []struct {
+		// Versions pushed before check, starting after previous case.
+		pushed  uint64
+		version uint64
+		want    []uint64
+		ok      bool
+	}{
+		{0, 0, []uint64{}, true},
+		{2, 0, []uint64{1, 2}, true},
+		{0, 1, []uint64{2}, true},
+		{0, 2, []uint64{}, true},
+		{0, 3, nil, false},
+		// Buffer is full and wraps around.
+		{3, 1, nil, false},
+		{0, 2, []uint64{3, 4, 5}, true},
+		{0, 4, []uint64{5}, true},
+		{4, 5, nil, false},
+		{0, 6, []uint64{7, 8, 9}, true},
+		{0, 8, []uint64{9}, true},
+	}
+
+	current := uint64(0)
+	for _, c := range cases {
+		for i := uint64(0); i < c.pushed; i++ {
+			current++
+			h.push(pixel(current))
+		}
+		got, ok := h.since(c.version, current)
+		if ok != c.ok {
+			t.Fatalf("since(%d, %d): ok is %v, want %v", c.version, current, ok, c.ok)
+		}
+		if !ok {
+			continue
+		}
+		want := make([]PixelInfo, len(c.want))
+		for i, version := range c.want {
+			want[i] = pixel(version)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("since(%d, %d) is %v, want %v", c.version, current, got, want)
+		}
+	}
+}
+
+func TestMatrixChangesSince(t *testing.T) {
+	shardMap := &common.ShardMap{
+		Version: 1,
+		Layout:  common.MustNewCanvasLayout(&common.CanvasConfig{CanvasCols: 8, CanvasRows: 8, ChunkSize: 4}, 2),
+	}
+	matrix := NewMatrix(shardMap, 0, 2)
+	epoch := matrix.Snapshot().Epoch
+
+	// (4, 0) belongs to other instance.
+	if _, ok := matrix.Apply(4, 0, 1, ""); ok {
+		t.Fatal("pixel of other instance is applied")
+	}
+	v1, _ := matrix.Apply(0, 0, 1, "1-0")
+	v2, _ := matrix.Apply(1, 0, 2, "2-0")
+
+	pixels, current, ok := matrix.ChangesSince(epoch, 0)
+	if !ok || current != v2 || len(pixels) != 2 || pixels[0].Version != v1 || pixels[1].Version != v2 {
+		t.Fatalf("ChangesSince(epoch, 0) is %v, %d, %v", pixels, current, ok)
+	}
+	if _, _, ok := matrix.ChangesSince(epoch+1, 0); ok {
+		t.Error("changes of matrix with other epoch are returned")
+	}
+	if _, _, ok := matrix.ChangesSince(epoch, v2+1); ok {
+		t.Error("changes after future version are returned")
+	}
+
+	// History keeps 2 changes.
+	v3, _ := matrix.Apply(2, 0, 3, "3-0")
+	if _, _, ok := matrix.ChangesSince(epoch, 0); ok {
+		t.Error("changes overwritten in history are returned")
+	}
+	pixels, _, ok = matrix.ChangesSince(epoch, v1)
+	if !ok || len(pixels) != 2 || pixels[0].Version != v2 || pixels[1].Version != v3 {
+		t.Errorf("ChangesSince(epoch, %d) is %v, %v", v1, pixels, ok)
+	}
+
+	// Restored data is not in history, clients resuming from older versions need snapshot.
+	if !matrix.Restore(make([]Color, len(matrix.Data)), "4-0") {
+		t.Fatal("data of the same size is not restored")
+	}
+	if _, _, ok := matrix.ChangesSince(epoch, v3); ok {
+		t.Error("changes made before restore are returned")
+	}
+	pixels, current, ok = matrix.ChangesSince(epoch, matrix.Snapshot().Version)
+	if !ok || len(pixels) != 0 || current != v3+1 {
+		t.Errorf("ChangesSince(epoch, current version) is %v, %d, %v", pixels, current, ok)
+	}
+}
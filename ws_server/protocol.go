@@ -0,0 +1,117 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+)
+
+// Binary protocol. Client asks for it with {"method": "connectMe", "args": {"binary": true}}.
+// Then snapshots and pixel updates are sent as binary frames, other messages are still JSON.
+// All numbers are big-endian. Canvas is identified by its index in AppConfig.Canvases.
+// Field sizes limit number of canvases, palette size, canvas size and number of shards,
+// config exceeding them is rejected (see common.MaxCanvases and others).
+//
+// Snapshot (allPixelsColors):
+//
+//	[0]      kind (binaryKindSnapshot)
+//	[1]      canvas index
+//	[2]      bits per pixel (4 or 8). With 4 bits the first pixel of each pair is in the high nibble.
+//	[3]      reserved
+//	[4:8]    instance number
+//	[8:12]   chunk size
+//	[12:20]  matrix version
+//	[20:28]  matrix epoch (see Matrix.ChangesSince)
+//	[28:]    packed color codes of instance chunks (see common.InstanceLayout)
+//
+// Pixel updates (pixelBatch), one message per instance:
+//
+//	[0]      kind (binaryKindPixelBatch)
+//	[1]      canvas index
+//	[2:4]    instance number (versions of pixels are versions of its matrix)
+//	[4:8]    number of pixels
+//	[8:]     pixels, 13 bytes each:
+//	         [0:2] x, [2:4] y, [4] color, [5:13] matrix version
+const (
+	binaryKindSnapshot   byte = 1
+	binaryKindPixelBatch byte = 3
+
+	binarySnapshotHeaderSize = 28
+	binaryBatchHeaderSize    = 8
+	binaryPixelSize          = 13
+)
+
+// Number of bits needed for color code of palette with given size.
+func bitsPerPixel(paletteSize int) int {
+	if paletteSize <= 16 {
+		return 4
+	}
+	return 8
+}
+
+func encodeBinarySnapshot(canvasIndex int, paletteSize int, snapshot *MatrixSnapshot, instance, chunkSize int) []byte {
+	bits := bitsPerPixel(paletteSize)
+	dataSize := len(snapshot.Data)
+	if bits == 4 {
+		dataSize = (len(snapshot.Data) + 1) / 2
+	}
+
+	buf := make([]byte, binarySnapshotHeaderSize+dataSize)
+	buf[0] = binaryKindSnapshot
+	buf[1] = byte(canvasIndex)
+	buf[2] = byte(bits)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(instance))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(chunkSize))
+	binary.BigEndian.PutUint64(buf[12:20], snapshot.Version)
+	binary.BigEndian.PutUint64(buf[20:28], snapshot.Epoch)
+
+	data := buf[binarySnapshotHeaderSize:]
+	if bits == 4 {
+		for i, color := range snapshot.Data {
+			if i%2 == 0 {
+				data[i/2] = byte(color) << 4
+			} else {
+				data[i/2] |= byte(color) & 0x0f
+			}
+		}
+	} else {
+		for i, color := range snapshot.Data {
+			data[i] = byte(color)
+		}
+	}
+
+	return buf
+}
+
+func encodeBinaryPixelBatch(canvasIndex int, instance int, pixels []PixelInfo) []byte {
+	buf := make([]byte, binaryBatchHeaderSize+len(pixels)*binaryPixelSize)
+	buf[0] = binaryKindPixelBatch
+	buf[1] = byte(canvasIndex)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(instance))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(pixels)))
+
+	for i := range pixels {
+		pixel := buf[binaryBatchHeaderSize+i*binaryPixelSize:]
+		binary.BigEndian.PutUint16(pixel[0:2], uint16(pixels[i].X))
+		binary.BigEndian.PutUint16(pixel[2:4], uint16(pixels[i].Y))
+		pixel[4] = byte(pixels[i].Color)
+		binary.BigEndian.PutUint64(pixel[5:13], pixels[i].Version)
+	}
+	return buf
+}
@@ -0,0 +1,83 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeBinarySnapshot(t *testing.T) {
+	snapshot := &MatrixSnapshot{
+		Data:    []Color{1, 15, 0, 7, 9},
+		Version: 0x0102030405060708,
+		Epoch:   0x1112131415161718,
+	}
+	header := []byte{
+		binaryKindSnapshot, 2, 0, 0,
+		0, 0, 1, 0x2c,
+		0, 0, 0, 32,
+		1, 2, 3, 4, 5, 6, 7, 8,
+		0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18,
+	}
+
+	cases := []struct {
+		name        string
+		paletteSize int
+		bits        byte
+		data        []byte
+	}{
+		// Odd number of pixels: low nibble of last byte is padding.
+		{"4 bits", 16, 4, []byte{0x1f, 0x07, 0x90}},
+		{"8 bits", 17, 8, []byte{1, 15, 0, 7, 9}},
+	}
+	for _, c := range cases {
+		want := append([]byte{}, header...)
+		want[2] = c.bits
+		want = append(want, c.data...)
+		got := encodeBinarySnapshot(2, c.paletteSize, snapshot, 300, 32)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: snapshot is %x, want %x", c.name, got, want)
+		}
+	}
+}
+
+func TestEncodeBinaryPixelBatch(t *testing.T) {
+	pixels := []PixelInfo{
+		{X: 0, Y: 65535, Color: 255, Version: 1},
+		{X: 258, Y: 3, Color: 4, Version: 0x0102030405060708},
+	}
+	want := []byte{
+		binaryKindPixelBatch, 7, 0x01, 0x02, 0, 0, 0, 2,
+		0, 0, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x01, 0x02, 0, 3, 4, 1, 2, 3, 4, 5, 6, 7, 8,
+	}
+	got := encodeBinaryPixelBatch(7, 258, pixels)
+	if !bytes.Equal(got, want) {
+		t.Errorf("batch is %x, want %x", got, want)
+	}
+	if len(got) != binaryBatchHeaderSize+len(pixels)*binaryPixelSize {
+		t.Errorf("batch is %d bytes long, want %d", len(got), binaryBatchHeaderSize+len(pixels)*binaryPixelSize)
+	}
+
+	empty := encodeBinaryPixelBatch(0, 0, nil)
+	if !bytes.Equal(empty, []byte{binaryKindPixelBatch, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("empty batch is %x", empty)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/go-redis/redis"
+	"github.com/pbsphp/ShittyPixels/common"
+)
+
+// Random id of this process in published placements (see common.LivePlacement).
+// Shard number is not enough: old and new primary of shard may publish at the same time.
+func newPublisherId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Relay placements accepted by other instances to clients of this instance.
+// Every instance publishes its placements (see handleSetPixelColor) in version order,
+// redis keeps order of messages of one publisher. Never returns.
+func RunRelay(rdb *redis.Client, canvases map[string]*Canvas, hub *Hub, publisherId string) {
+	names := make([]string, 0, len(canvases))
+	for name := range canvases {
+		names = append(names, name)
+	}
+	pubsub := common.SubscribePlacements(rdb, names)
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		placement, err := common.ParseLivePlacement(msg)
+		if err != nil {
+			logError("parse live placement", err)
+			continue
+		}
+		if placement.Publisher == publisherId {
+			// Already broadcast by this instance.
+			continue
+		}
+		canvas, ok := canvases[placement.Canvas]
+		if !ok {
+			continue
+		}
+
+		pixel := PixelInfo{
+			X:       placement.X,
+			Y:       placement.Y,
+			Color:   Color(placement.Color),
+			Version: placement.Version,
+		}
+		hub.RelayPixel(canvas, placement.Shard, &pixel)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/go-redis/redis"
+	"github.com/pbsphp/ShittyPixels/common"
+	"log"
+	"time"
+)
+
+// Follow placement log of shard primary until its lease lapses, then take the lease over.
+// Canvases stay up to date, so promoted replica serves the same pixels primary did.
+// Return when lease is acquired.
+func RunReplica(
+	rdb *redis.Client,
+	canvases map[string]*Canvas,
+	lease *common.ShardLease,
+	ttl time.Duration,
+) error {
+	log.Printf("replica of shard %d\n", lease.Shard)
+	defer func() {
+		if err := lease.UnregisterReplica(rdb); err != nil {
+			logError("unregister replica", err)
+		}
+	}()
+
+	for {
+		if err := lease.RegisterReplica(rdb, ttl); err != nil {
+			logError("register replica", err)
+		}
+
+		acquired, err := lease.Acquire(rdb, ttl)
+		if err != nil {
+			logError("acquire shard lease", err)
+		}
+		if acquired {
+			// Old primary can not log placements anymore (see common.AppendPlacement),
+			// so the rest of the log is final.
+			for {
+				applied, err := applyNewPlacements(rdb, canvases, lease.Shard, -1)
+				if err != nil {
+					return err
+				}
+				if applied == 0 {
+					break
+				}
+			}
+			log.Printf("promoted to primary of shard %d\n", lease.Shard)
+			return nil
+		}
+
+		if _, err := applyNewPlacements(rdb, canvases, lease.Shard, ttl/3); err != nil {
+			logError("follow placements", err)
+			time.Sleep(ttl / 3)
+		}
+	}
+}
+
+// Wait up to `block' for new placements of shard and apply them. Negative `block' does not wait.
+// Return number of applied placements.
+func applyNewPlacements(rdb *redis.Client, canvases map[string]*Canvas, shard int, block time.Duration) (int, error) {
+	afterIds := make(map[string]string)
+	for name, canvas := range canvases {
+		if err := canvas.CatchUpWithCheckpoint(rdb); err != nil {
+			return 0, err
+		}
+		afterIds[name] = canvas.matrix.LastPlacementId()
+	}
+
+	events, err := common.ReadNewPlacements(rdb, shard, afterIds, block)
+	if err != nil {
+		return 0, err
+	}
+	applyPlacements(canvases, events)
+	return len(events), nil
+}
+
+// Apply logged placements to canvases. Placements canvas has applied already are ignored.
+func applyPlacements(canvases map[string]*Canvas, events []common.PlacementEvent) {
+	for i := range events {
+		event := &events[i]
+		canvas := canvases[event.Canvas]
+		// Canvas may be switched to other shard map meanwhile (see Canvas.Reload).
+		canvas.placementMu.Lock()
+		if common.PlacementIdLess(canvas.matrix.LastPlacementId(), event.Id) {
+			if int(event.Color) >= len(canvas.config.PaletteColors) {
+				// Color outside of palette. Do not read it again.
+				canvas.matrix.SkipPlacement(event.Id)
+			} else if _, ok := canvas.matrix.Apply(event.X, event.Y, Color(event.Color), event.Id); !ok {
+				// Logged with other layout. Do not read it again.
+				canvas.matrix.SkipPlacement(event.Id)
+			}
+		}
+		canvas.placementMu.Unlock()
+	}
+}
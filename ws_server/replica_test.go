@@ -0,0 +1,64 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/pbsphp/ShittyPixels/common"
+	"testing"
+)
+
+func TestApplyPlacements(t *testing.T) {
+	config := &common.CanvasConfig{Name: "main", CanvasCols: 8, CanvasRows: 4, ChunkSize: 4, PaletteColors: make([]string, 4)}
+	shardMap := &common.ShardMap{Version: 1, Layout: common.MustNewCanvasLayout(config, 2)}
+	matrix := NewMatrix(shardMap, 0, 4)
+	matrix.SkipPlacement("10-0")
+	canvas := &Canvas{config: config, matrix: &matrix}
+
+	event := func(id string, x, y int, color uint8) common.PlacementEvent {
+		return common.PlacementEvent{Id: id, Canvas: "main", X: x, Y: y, Color: color}
+	}
+	applyPlacements(map[string]*Canvas{"main": canvas}, []common.PlacementEvent{
+		// Applied already (included into checkpoint).
+		event("9-0", 0, 0, 1),
+		event("10-0", 1, 0, 1),
+		event("11-0", 2, 0, 2),
+		// Color outside of palette.
+		event("12-0", 3, 0, 4),
+		// Pixel of other instance, logged with other layout.
+		event("13-0", 4, 0, 3),
+		event("14-0", 0, 1, 3),
+	})
+
+	want := map[[2]int]Color{{0, 0}: 0, {1, 0}: 0, {2, 0}: 2, {3, 0}: 0, {0, 1}: 3}
+	for p, color := range want {
+		if got, _ := matrix.Get(p[0], p[1]); got != color {
+			t.Errorf("(%d, %d) is %d, want %d", p[0], p[1], got, color)
+		}
+	}
+	if id := matrix.LastPlacementId(); id != "14-0" {
+		t.Errorf("last placement id is %q, want 14-0", id)
+	}
+
+	// The same placements read again change nothing.
+	version := matrix.Snapshot().Version
+	applyPlacements(map[string]*Canvas{"main": canvas}, []common.PlacementEvent{event("14-0", 0, 1, 1)})
+	if got, _ := matrix.Get(0, 1); got != 3 || matrix.Snapshot().Version != version {
+		t.Errorf("placement is applied twice: (0, 1) is %d", got)
+	}
+}
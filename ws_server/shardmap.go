@@ -0,0 +1,131 @@
+/*
+   ShittyPixels
+   Copyright © 2019  Pbsphp
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/go-redis/redis"
+	"github.com/gorilla/websocket"
+	"github.com/pbsphp/ShittyPixels/common"
+	"time"
+)
+
+// Tell client which instance owns each chunk:
+//
+//	{
+//	    "kind": "shardMap",
+//	    "data": {
+//	        "version": <shard map version>,
+//	        "chunkSize": <chunk size>,
+//	        "chunksX": <chunks in row>,
+//	        "chunkOwners": [<instance owning chunk>, ...],
+//	        "addresses": [<address of instance>, ...] (only if there is no gateway)
+//	    }
+//	}
+//
+// Client with older version should reconnect, its snapshots are made for other layout.
+// Sent as JSON in both protocols.
+func prepareShardMapMessage(
+	rdb *redis.Client,
+	appConfig *common.AppConfig,
+	canvas *Canvas,
+	layout *common.CanvasLayout,
+	version int64,
+) (*websocket.PreparedMessage, error) {
+	var addresses []string
+	if appConfig.GatewayAddress == "" {
+		var err error
+		addresses, err = common.GetShardAddresses(rdb, layout.Shards)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return prepareResponse(websocket.TextMessage, &WebSocketResponseData{
+		Kind:   "shardMap",
+		Canvas: canvas.config.Name,
+		Data: struct {
+			Version     int64    `json:"version"`
+			ChunkSize   int      `json:"chunkSize"`
+			ChunksX     int      `json:"chunksX"`
+			ChunkOwners []int    `json:"chunkOwners"`
+			Addresses   []string `json:"addresses,omitempty"`
+		}{
+			Version:     version,
+			ChunkSize:   layout.ChunkSize,
+			ChunksX:     layout.ChunksX,
+			ChunkOwners: layout.Owners,
+			Addresses:   addresses,
+		},
+	})
+}
+
+// Switch canvases to new shard maps when resharding is finished (see common.Reshard)
+// and tell subscribed clients about it. If new shard map has no shard of this instance
+// (there are fewer shards now), close retired and return.
+func RunShardMapWatcher(
+	rdb *redis.Client,
+	appConfig *common.AppConfig,
+	canvases map[string]*Canvas,
+	hub *Hub,
+	retired chan<- struct{},
+) {
+	pubsub := rdb.Subscribe(common.ShardMapUpdatesChannel)
+	defer pubsub.Close()
+	updates := pubsub.Channel()
+
+	// Notification may be lost while redis connection is broken, so check maps from time to time.
+	ticker := time.NewTicker(common.ShardLeaseTTL(appConfig))
+	defer ticker.Stop()
+
+	// Return true if instance shard is not in new shard map.
+	reload := func(canvas *Canvas) bool {
+		shardMap, err := canvas.Reload(rdb)
+		if err != nil {
+			logError("reload canvas", err)
+			return false
+		}
+		if shardMap == nil {
+			return false
+		}
+		msg, err := prepareShardMapMessage(rdb, appConfig, canvas, shardMap.Layout, shardMap.Version)
+		if err != nil {
+			logError("prepare shard map", err)
+		} else {
+			hub.Broadcast(canvas.config.Name, msg, msg)
+		}
+		return canvas.instanceNumber >= shardMap.Layout.Shards
+	}
+
+	for {
+		select {
+		case msg := <-updates:
+			if canvas, ok := canvases[msg.Payload]; ok && reload(canvas) {
+				close(retired)
+				return
+			}
+		case <-ticker.C:
+			for _, canvas := range canvases {
+				if reload(canvas) {
+					close(retired)
+					return
+				}
+			}
+		}
+	}
+}